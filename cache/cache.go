@@ -2,8 +2,10 @@
 package cache
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"sync/atomic"
 	"time"
 
@@ -19,8 +21,34 @@ var (
 	ErrNilPointer = errors.New("Nil pointer is not permitted")
 	ErrRESPParse = errors.New("RESP parse error")
 	ErrSetFailed = errors.New("Set operation failed by constraint")
+	ErrDelFailed = errors.New("Del operation failed by constraint")
+	ErrNegative = errors.New("Negative cached")
+	ErrStale = errors.New("Stale by the validity serial")
+	ErrInvalidated = errors.New("Invalidated by tags")
+	ErrBehind = errors.New("Older than the minimum serial")
 )
 
+// MissError describes why a stored value is regarded as a miss.
+// It matches ErrNoKey with errors.Is, as well as its Reason, ErrStale, ErrInvalidated or ErrBehind,
+// so callers not interested in the reason could handle it as a genuine miss.
+type MissError struct {
+	Reason error
+
+	// Serial of the newest stored value
+	Serial int64
+
+	// Validity serial of the redis instance, which the stored value should be newer than
+	ValidSince int64
+}
+
+func (m *MissError) Error() string {
+	return fmt.Sprintf("%s: serial %d, valid since %d", m.Reason, m.Serial, m.ValidSince)
+}
+
+func (m *MissError) Is(target error) bool {
+	return target == ErrNoKey || target == m.Reason
+}
+
 // CacheOptions describes various paramters to control cache behaviors
 type CacheOptions struct {
 
@@ -32,12 +60,79 @@ type CacheOptions struct {
 	
 	// Cache expiration time
 	Expiration time.Duration	
+
+	// Upper bound of a random duration added to relative expiration times,
+	// to spread expirations of the values stored at once
+	ExpirationJitter time.Duration
+
+	// Number of versions kept for a key, 10 if not set.
+	// With 1, only the current value would be kept, as a plain string value rather than a sorted set.
+	// It could be changed any time, and keys are converted on their next writes.
+	HistoryDepth int
+
+	// Versions older than this, relative to the current one, would be dropped if set.
+	// The current version is always kept regardless of its age.
+	MaxVersionAge time.Duration
+
+	// Marshaled values larger than this would be compressed with deflate, if set.
+	// Compressed and uncompressed values could coexist, so it could be changed any time.
+	CompressThreshold int
+
+	// Compression level of the deflate, flate.DefaultCompression if not set.
+	CompressLevel int
+
+	// Keyring to encrypt values with AES-GCM, if set.
+	// Once set, values not encrypted would be rejected with ErrDecrypt on reads.
+	Keyring *Keyring
+
+	// Values older than this are soft-expired, if set.
+	// Soft-expired values are still served until the hard expiration,
+	// while being refreshed in background by the Loader.
+	SoftExpiration time.Duration
+
+	// Loader for background refreshes of soft-expired values,
+	// also for GetOrLoad when no loader given.
+	Loader Loader
+
+	// Expiration time of tombstones for absent entities.
+	// If set, loaders reporting ErrNotFound would make tombstones, i.e. negative cache entries.
+	NegativeExpiration time.Duration
+
+	// Scale factor for the probabilistic early recomputation, XFetch, if set.
+	// Values with loaders would be refreshed in background before their expiration,
+	// earlier with larger factors and longer recompute costs. 1.0 is a good start.
+	EarlyRecompute float64
+
+	// Source of serials for values to store, WallClock if not set.
+	SerialSource SerialSource
+
+	// Number of replicas to read for Get, if the connector is a ReplicaConnector.
+	// Get returns the newest value of them, and repairs the others in background.
+	// If not more than 1, Get reads only the redis instance which Connect locates.
+	ReadReplicas int
+
+	// Maximum number of retries of Update on conflicts, 10 if not set.
+	UpdateRetries int
+
+	// Base backoff between retries of Update, 10ms if not set.
+	// It doubles for each retry up to a second, and a random duration up to it would be taken.
+	UpdateBackoff time.Duration
 }
 
 // Main object for the cache
 type Cache struct {
 	connector Connector
 	options *CacheOptions
+
+	// Loads in flight, coalesced by keys
+	flight *flight
+
+	// Near caches to publish writes for
+	near *nearHub
+
+	// Key prefix and implicit tags of a namespace view, if any
+	prefix []byte
+	nstags []string
 	
 	// Counters for statistical usages
 	hits, misses, loads int64
@@ -52,12 +147,14 @@ func NewCache(connector Connector, options *CacheOptions) (*Cache, error) {
 	cache := &Cache{
 		connector: connector,
 		options: options,
+		flight: &flight{},
+		near: &nearHub{},
 	}
 	if cache.options == nil {
 		cache.options = &CacheOptions{
-			defaultMarshal,
-			defaultUnmarshal,
-			60 * time.Second,
+			Marshal: defaultMarshal,
+			Unmarshal: defaultUnmarshal,
+			Expiration: 60 * time.Second,
 		}
 	}
 	if cache.options.Marshal == nil {
@@ -97,117 +194,408 @@ func defaultUnmarshal(d []byte, v interface{}) error {
 	}
 }
 
-// returns timestamp in millis
-func getSerial() int64 {
-	return time.Now().UnixNano() / 1000
+// Connect to a redis instance for the key within the context.
+// If the connector is not a ContextConnector, the context would be checked only before connecting.
+func (c *Cache) connect(ctx context.Context, bkey []byte) (*redis.Client, func(), int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, 0, err
+	}
+	if cc, ok := c.connector.(ContextConnector); ok {
+		return cc.ConnectContext(ctx, bkey)
+	}
+	return c.connector.Connect(bkey)
 }
 
-// Lua script for getting a cached value.
-// Cached values are stored in a size-limited sorted set.
-// This script would get the most recent value and check its validity with a given serial
-// If valid, returns the value with its serial.
-const luaForGet =
-	"local cur=redis.call('ZREVRANGE', KEYS[1], 0, 0, 'WITHSCORES') " +
-	"if cur[1] and cur[2] and tonumber(cur[2]) > tonumber(ARGV[1]) then " +
-	"  return {cur[1], math.floor(cur[2])}" +
+// Evaluate a lua script within the context.
+func luaEval(ctx context.Context, client *redis.Client, script string, keys int, args ...interface{}) *redis.Resp {
+	return Roundtrip(ctx, client, func() *redis.Resp {
+		return util.LuaEval(client, script, keys, args...)
+	})
+}
+
+// Lua functions for reading versions of a cached value.
+// Cached values are stored in a size-limited sorted set scored by serials,
+// or in a plain string of the serial and the value separated by a space, with the history depth 1.
+// Like ZREVRANGE WITHSCORES, current returns the most recent value and its serial, or an empty table if none,
+// and versions returns all of them from the newest. version returns the value with the serial, or nil if none.
+const luaCurrentFunc =
+	"local function current(key) " +
+	"  local t=redis.call('TYPE', key).ok " +
+	"  if t == 'zset' then " +
+	"    return redis.call('ZREVRANGE', key, 0, 0, 'WITHSCORES') " +
+	"  elseif t == 'string' then " +
+	"    local s=redis.call('GET', key) " +
+	"    local i=string.find(s, ' ', 1, true) " +
+	"    if i and string.match(string.sub(s, 1, i - 1), '^%d+$') then " +
+	"      return {string.sub(s, i + 1), string.sub(s, 1, i - 1)} " +
+	"    end " +
+	"  end " +
+	"  return {} " +
+	"end " +
+	"local function versions(key) " +
+	"  if redis.call('TYPE', key).ok == 'zset' then " +
+	"    return redis.call('ZREVRANGE', key, 0, -1, 'WITHSCORES') " +
+	"  end " +
+	"  return current(key) " +
 	"end " +
-	"return false "
+	"local function version(key, serial) " +
+	"  if redis.call('TYPE', key).ok == 'zset' then " +
+	"    return redis.call('ZRANGEBYSCORE', key, serial, serial)[1] " +
+	"  end " +
+	"  local cur=current(key) " +
+	"  if cur[2] and tonumber(cur[2]) == tonumber(serial) then " +
+	"    return cur[1] " +
+	"  end " +
+	"  return nil " +
+	"end "
+
+// Lua function for getting a cached value.
+// This function would get the most recent value and check its validity,
+// i.e. written after the validity serial, and its serial is newer than the minimum.
+// If valid, returns the value with its serial and remaining time to live in millis.
+const luaGetFunc = luaValidFunc + luaWrittenFunc + luaCurrentFunc +
+	"local function get(key, since, min) " +
+	"  local cur=current(key) " +
+	"  if not cur[1] or not cur[2] then " +
+	"    return false " +
+	"  end " +
+	"  if written(cur[1], cur[2]) <= tonumber(since) then " +
+	"    return {'stale', math.floor(cur[2])} " +
+	"  end " +
+	"  if tonumber(cur[2]) <= tonumber(min) then " +
+	"    return {'behind', math.floor(cur[2])} " +
+	"  end " +
+	"  if not valid(cur[1]) then " +
+	"    return {'invalidated', math.floor(cur[2])} " +
+	"  end " +
+	"  return {cur[1], math.floor(cur[2]), redis.call('PTTL', key)} " +
+	"end "
+
+// Lua script for getting a cached value.
+const luaForGet = luaGetFunc +
+	"return get(KEYS[1], ARGV[1], ARGV[2]) "
 
 // Get returns a cached value using bound Connector.
 // It takes key, value parameters as an interface{} type and performs marshal/unmarshal for them.
+// For a tombstone of an absent entity, it returns ErrNegative with the serial of the tombstone.
+// If the key does not exist, it returns ErrNoKey.
+// If a stored value is not newer than the validity serial of the connector, or invalidated by tags,
+// it returns a MissError with the reason, which also matches ErrNoKey with errors.Is.
+// A soft-expired value would be returned as well, triggering a background refresh.
+// Use GetWithStale to tell whether it is soft-expired.
 func (c *Cache) Get(key interface{}, val interface{}) (int64, error) {
-	bkey, err := c.options.Marshal(key)
+	return c.GetContext(context.Background(), key, val)
+}
+
+// GetContext is same with Get, but it returns ctx.Err()
+// as soon as the context is done while connecting or waiting for the reply.
+func (c *Cache) GetContext(ctx context.Context, key interface{}, val interface{}) (int64, error) {
+	it, err := c.get(ctx, key, val, 0, c.options.Loader)
+	return it.serial, err
+}
+
+// GetWithStale returns a cached value like Get, flagging whether it is soft-expired.
+// The flag is decided by the age of the stored value when read, so a stale value is flagged
+// until its background refresh is stored. It is always false unless SoftExpiration of CacheOptions is set.
+func (c *Cache) GetWithStale(key interface{}, val interface{}) (int64, bool, error) {
+	return c.GetWithStaleContext(context.Background(), key, val)
+}
+
+// GetWithStaleContext is same with GetWithStale within the context.
+func (c *Cache) GetWithStaleContext(ctx context.Context, key interface{}, val interface{}) (int64, bool, error) {
+	it, err := c.get(ctx, key, val, 0, c.options.Loader)
+	return it.serial, it.stale, err
+}
+
+// GetMinSerial returns a cached value like Get, but only if its serial is not less than the minimum serial.
+// Use a serial observed from Set, or Get, for the read-your-writes consistency.
+// An older value, possibly read from another redis instance after failover,
+// is regarded as a miss with a MissError of ErrBehind.
+func (c *Cache) GetMinSerial(key interface{}, val interface{}, minSerial int64) (int64, error) {
+	return c.GetMinSerialContext(context.Background(), key, val, minSerial)
+}
+
+// GetMinSerialContext is same with GetMinSerial within the context.
+func (c *Cache) GetMinSerialContext(ctx context.Context, key interface{}, val interface{}, minSerial int64) (int64, error) {
+	it, err := c.get(ctx, key, val, minSerial, c.options.Loader)
+	return it.serial, err
+}
+
+// Get a cached value not older than the minimum serial, refreshing it with the loader if soft-expired.
+func (c *Cache) get(ctx context.Context, key interface{}, val interface{}, minSerial int64, loader Loader) (item, error) {
+	bkey, err := c.marshalKey(key)
 	if err != nil {
-		return 0, err
+		return item{}, err
 	}
-	client, disconnect, validSince, err := c.connector.Connect(bkey)
+	bval, it, err := c.fetch(ctx, key, bkey, minSerial, loader)
 	if err != nil {
-		return 0, err
+		return it, err
+	}
+	if err := c.options.Unmarshal(bval, val); err != nil {
+		return item{}, err
+	}
+	return it, nil
+}
+
+// Fetch a decoded value with a marshaled key, refreshing it with the loader if soft-expired.
+func (c *Cache) fetch(ctx context.Context, key interface{}, bkey []byte, minSerial int64, loader Loader) ([]byte, item, error) {
+	if c.options.ReadReplicas > 1 {
+		return c.fetchReplicas(ctx, key, bkey, minSerial, loader)
+	}
+	client, disconnect, validSince, err := c.connect(ctx, bkey)
+	if err != nil {
+		return nil, item{}, err
 	}
 	defer func(){ if disconnect != nil { disconnect() } }()
-	
-	resp := util.LuaEval(client, luaForGet, 1, bkey, validSince)
+
+	resp := luaEval(ctx, client, luaForGet, 1, bkey, validSince, minSerial - 1)
 	if resp.Err != nil {
-		return 0, resp.Err
+		return nil, item{}, resp.Err
+	}
+	bval, it, err := c.parseGet(bkey, resp, validSince)
+	if err == nil || err == ErrNegative {
+		c.revalidate(key, bkey, it, loader)
+	}
+	return bval, it, err
+}
+
+// Properties of a cached value
+type item struct {
+	serial int64
+
+	// Remaining time to live, negative if no expiration
+	ttl time.Duration
+
+	// Recorded cost to recompute the value, zero if unknown
+	cost time.Duration
+
+	// Stored value with its headers
+	data []byte
+
+	// Whether the value is soft-expired when read
+	stale bool
+}
+
+// Unmarshal a reply of the get function into the value and returns its properties.
+func (c *Cache) unmarshalGet(bkey []byte, resp *redis.Resp, validSince int64, val interface{}) (item, error) {
+	bval, it, err := c.parseGet(bkey, resp, validSince)
+	if err != nil {
+		return it, err
+	}
+	if err := c.options.Unmarshal(bval, val); err != nil {
+		return item{}, err
 	}
+	return it, nil
+}
+
+// Parse a reply of the get function into the decoded value and its properties.
+// It also counts hits and misses.
+func (c *Cache) parseGet(bkey []byte, resp *redis.Resp, validSince int64) ([]byte, item, error) {
 	if resp.IsType(redis.Nil) {
 		atomic.AddInt64(&c.misses, 1)
-		return 0, ErrNoKey
+		return nil, item{}, ErrNoKey
 	}
 
 	if resp.IsType(redis.Array) {
 		if res, err := resp.Array(); err == nil && len(res) == 2 {
-			if res[0].IsType(redis.BulkStr) && res[1].IsType(redis.Int) {
+			reason, _ := res[0].Str()
+			serial, err := res[1].Int64()
+			if err != nil {
+				return nil, item{}, ErrRESPParse
+			}
+			atomic.AddInt64(&c.misses, 1)
+			switch {
+			case reason == "stale":
+				return nil, item{}, &MissError{Reason: ErrStale, Serial: serial, ValidSince: validSince}
+			case reason == "behind":
+				return nil, item{}, &MissError{Reason: ErrBehind, Serial: serial, ValidSince: validSince}
+			case reason == "invalidated":
+				return nil, item{}, &MissError{Reason: ErrInvalidated, Serial: serial, ValidSince: validSince}
+			default:
+				return nil, item{}, ErrNoKey
+			}
+		} else if err == nil && len(res) == 3 {
+			if res[0].IsType(redis.BulkStr) && res[1].IsType(redis.Int) && res[2].IsType(redis.Int) {
 				bval, _ := res[0].Bytes()
 				serial, _ := res[1].Int64()
-				if err := c.options.Unmarshal(bval, val); err != nil {
-					return 0, err
+				pttl, _ := res[2].Int64()
+				it := item{
+					serial: serial,
+					ttl: time.Duration(pttl) * time.Millisecond,
+					cost: costOf(bval),
+					data: bval,
+					stale: c.isStale(writtenOf(bval, serial)),
+				}
+				c.observe(serial)
+				bval, err := c.decode(bkey, bval)
+				if err == ErrNegative {
+					atomic.AddInt64(&c.hits, 1)
+					return nil, it, err
+				} else if err != nil {
+					return nil, item{}, err
 				}
 				atomic.AddInt64(&c.hits, 1)
-				return serial, nil
+				return bval, it, nil
 			}
 		}
 	}
-	return 0, ErrRESPParse
+	return nil, item{}, ErrRESPParse
 }
 
-// Lua script for setting a cache value.
-// Cached values are stored in a size-limited sorted set.
-// This script would make sure a given value is the most recent one.
-// Then it adds a value to the set, truncates the set to maintain the size,
+// Lua function for setting expiration time of a cache value.
+// The mode would be one of 'px', 'pxat', 'persist' and 'keep'.
+// With 'keep', the expiration time of an existing value is kept as is,
+// and a new value gets the given relative expiration time.
+const luaExpireFunc =
+	"local function expire(key, existed, mode, ms) " +
+	"  if mode == 'pxat' then " +
+	"    redis.call('PEXPIREAT', key, ms) " +
+	"  elseif mode == 'persist' then " +
+	"    redis.call('PERSIST', key) " +
+	"  elseif (mode == 'px' or not existed) and tonumber(ms) > 0 then " +
+	"    redis.call('PEXPIRE', key, ms) " +
+	"  end " +
+	"end "
+
+// Lua function for truncating versions of a cache value in a sorted set.
+// It keeps the given number of recent versions, and drops ones older than the floor if set.
+const luaTrimFunc =
+	"local function trim(key, depth, floor) " +
+	"  redis.call('ZREMRANGEBYRANK', key, 0, -1 - tonumber(depth)) " +
+	"  if tonumber(floor) > 0 then " +
+	"    redis.call('ZREMRANGEBYSCORE', key, '-inf', '(' .. floor) " +
+	"  end " +
+	"end "
+
+// Lua function for storing a version of a cache value, keeping the expiration time of the key.
+// With the history depth 1, it is stored as a plain string, replacing a sorted set if any.
+// Otherwise, it is added to the sorted set, converting a plain string if any, and the set is truncated.
+const luaPutFunc = luaCurrentFunc + luaTrimFunc +
+	"local function put(key, val, serial, depth, floor) " +
+	"  local t=redis.call('TYPE', key).ok " +
+	"  if tonumber(depth) > 1 and t ~= 'string' then " +
+	"    redis.call('ZADD', key, serial, val) " +
+	"    trim(key, depth, floor) " +
+	"    return " +
+	"  end " +
+	"  local cur=current(key) " +
+	"  local pttl=redis.call('PTTL', key) " +
+	"  if tonumber(depth) > 1 then " +
+	"    redis.call('DEL', key) " +
+	"    if cur[1] then " +
+	"      redis.call('ZADD', key, cur[2], cur[1]) " +
+	"    end " +
+	"    redis.call('ZADD', key, serial, val) " +
+	"    trim(key, depth, floor) " +
+	"  else " +
+	"    redis.call('SET', key, serial .. ' ' .. val) " +
+	"  end " +
+	"  if pttl > 0 then " +
+	"    redis.call('PEXPIRE', key, pttl) " +
+	"  end " +
+	"end "
+
+// Lua function for setting a cache value.
+// Cached values are stored in a size-limited sorted set, or a plain string with the history depth 1.
+// This function would make sure a given value is the most recent one.
+// Then it puts a value, truncating versions to maintain the size,
 // and sets expiration time.
-const luaForSet =
-	"local cur=redis.call('ZREVRANGE', KEYS[1], 0, 0, 'WITHSCORES') " +
-	"if cur[1] and cur[2] and tonumber(cur[2]) > tonumber(ARGV[2]) then " +
-	"  return false " +
-	"end " +
-	"redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1]) " +
-	"redis.call('ZREMRANGEBYRANK', KEYS[1], 0, -11) " +
-	"if tonumber(ARGV[3]) > 0 then " +
-	"  redis.call('EXPIRE', KEYS[1], ARGV[3]) " +
-	"end " +
-	"return 1"
+const luaSetFunc = luaExpireFunc + luaPutFunc + luaTagFunc +
+	"local function set(key, val, serial, mode, ms, depth, floor, tags) " +
+	"  local cur=current(key) " +
+	"  if cur[1] and cur[2] and tonumber(cur[2]) > tonumber(serial) then " +
+	"    return false " +
+	"  end " +
+	"  put(key, tag(val, tags), serial, depth, floor) " +
+	"  expire(key, cur[1], mode, ms) " +
+	"  return 1 " +
+	"end "
+
+// Lua script for setting a cache value.
+const luaForSet = luaSetFunc +
+	"return set(KEYS[1], ARGV[1], ARGV[2], ARGV[3], ARGV[4], ARGV[5], ARGV[6], ARGV[7]) "
 
 // Set put a value with a key into the Cache.
 // It takes key, value parameters as an interface{} type and performs marshal for them.
-// If succeed, it returns a serial number(an unix timestamp in millis) for the value.
+// If succeed, it returns a serial number(an unix timestamp in micros by default) for the value.
 // If a value of newer serial already exists, Set would fail with ErrSetFailed.
-func (c *Cache) Set(key interface{}, val interface{}) (int64, error) {
-	bkey, err := c.options.Marshal(key)
+// The expiration time follows CacheOptions unless overridden by SetOptions.
+// If the key is replicated, the value is stored on the primary replica first, then on the others.
+// Failures on the others are ignored, since they would be repaired by reads with ReadReplicas.
+func (c *Cache) Set(key interface{}, val interface{}, opts ...SetOption) (int64, error) {
+	return c.SetContext(context.Background(), key, val, opts...)
+}
+
+// SetContext is same with Set, but it returns ctx.Err()
+// as soon as the context is done while connecting or waiting for the reply.
+// Note that the value might be stored even if the context is done during the round trip.
+func (c *Cache) SetContext(ctx context.Context, key interface{}, val interface{}, opts ...SetOption) (int64, error) {
+	bkey, err := c.marshalKey(key)
 	if err != nil {
 		return 0, err
 	}
-	client, disconnect, _, err := c.connector.Connect(bkey)
+	bval, err := c.options.Marshal(val)
 	if err != nil {
 		return 0, err
 	}
-	defer func(){ if disconnect != nil { disconnect() } }()
-	
-	bval, err := c.options.Marshal(val)
+	return c.setBytes(ctx, bkey, bval, opts)
+}
+
+// Set a marshaled value with a marshaled key.
+func (c *Cache) setBytes(ctx context.Context, bkey []byte, bval []byte, opts []SetOption) (int64, error) {
+	data, err := c.encodeWith(bkey, bval, opts)
 	if err != nil {
 		return 0, err
 	}
-	serial := getSerial()
-	resp := util.LuaEval(client, luaForSet, 1, bkey, bval, serial, c.options.Expiration.Seconds())
-	if resp.Err != nil {
-		return 0, resp.Err
+	return c.setData(ctx, bkey, data, opts)
+}
+
+// Set an encoded value with a marshaled key.
+func (c *Cache) setData(ctx context.Context, bkey []byte, data []byte, opts []SetOption) (int64, error) {
+	mode, ms, err := c.expiration(opts)
+	if err != nil {
+		return 0, err
 	}
-	if resp.IsType(redis.Nil) {
-		return 0, ErrSetFailed
+	conns := c.connectReplicas(WithWrite(ctx), bkey)
+	defer disconnectAll(conns)
+	primary := firstConnected(conns)
+	if primary == nil {
+		return 0, conns[0].Err
+	}
+
+	serial, err := c.serial(ctx, primary.Client, opts)
+	if err != nil {
+		return 0, err
+	}
+	depth, floor := c.retention(serial)
+	tags := c.tags(opts)
+	err = replicate(conns, primary, func(conn *Conn) error {
+		resp := luaEval(ctx, conn.Client, luaForSet, 1, bkey, data, serial, mode, ms, depth, floor, tags)
+		if resp.Err != nil {
+			return resp.Err
+		}
+		if resp.IsType(redis.Nil) {
+			return ErrSetFailed
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return 0, err
 	}
 
 	atomic.AddInt64(&c.loads, 1)
+	c.notify(ctx, [][]byte{bkey}, []int64{serial})
 	return serial, nil
 }
 
 // Lua script for setting a cache value.
-// Cached values are stored in a size-limited sorted set.
+// Cached values are stored in a size-limited sorted set, or a plain string with the history depth 1.
 // This script would make sure a given value is the most recent one,
 // also the stored value is not newer than given serial.
-// Then it adds a value to the set, truncates the set to maintain the size,
+// Then it puts a value, truncating versions to maintain the size,
 // and sets expiration time.
-const luaForCheckAndSet =
-	"local cur=redis.call('ZREVRANGE', KEYS[1], 0, 0, 'WITHSCORES') " +
+const luaForCheckAndSet = luaExpireFunc + luaPutFunc + luaTagFunc +
+	"local cur=current(KEYS[1]) " +
 	"if cur[1] and cur[2] then " +
 	"  if tonumber(cur[2]) > tonumber(ARGV[2]) then " +
 	"    return false " +
@@ -216,64 +604,209 @@ const luaForCheckAndSet =
 	"    return false " +
 	"  end " +
 	"end " +
-	"redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1]) " +
-	"redis.call('ZREMRANGEBYRANK', KEYS[1], 0, -11) " +
-	"if tonumber(ARGV[4]) > 0 then " +
-	"  redis.call('EXPIRE', KEYS[1], ARGV[4]) " +
-	"end " +
+	"put(KEYS[1], tag(ARGV[1], ARGV[8]), ARGV[3], ARGV[6], ARGV[7]) " +
+	"expire(KEYS[1], cur[1], ARGV[4], ARGV[5]) " +
 	"return 1 "
 
 // CheckAndSet put a value with a key into the Cache,
 // ONLY IF it has no newer values with, i.e. no update since, a given serial.
 // It takes key, value parameters as an interface{} type and performs marshal for them.
-// If succeed, it returns a serial number(an unix timestamp in millis) for the value.
+// If succeed, it returns a serial number(an unix timestamp in micros by default) for the value.
 // If a value of newer serial already exists, CheckAndSet would fail with ErrSetFailed.
-func (c *Cache) CheckAndSet(key interface{}, val interface{}, oserial int64) (int64, error) {
-	bkey, err := c.options.Marshal(key)
+// The expiration time follows CacheOptions unless overridden by SetOptions.
+// If the key is replicated, only the primary replica is checked, and the others follow it like Set.
+func (c *Cache) CheckAndSet(key interface{}, val interface{}, oserial int64, opts ...SetOption) (int64, error) {
+	return c.CheckAndSetContext(context.Background(), key, val, oserial, opts...)
+}
+
+// CheckAndSetContext is same with CheckAndSet, but it returns ctx.Err()
+// as soon as the context is done while connecting or waiting for the reply.
+// Note that the value might be stored even if the context is done during the round trip.
+func (c *Cache) CheckAndSetContext(ctx context.Context, key interface{}, val interface{}, oserial int64, opts ...SetOption) (int64, error) {
+	bkey, err := c.marshalKey(key)
 	if err != nil {
 		return 0, err
 	}
-	client, disconnect, _, err := c.connector.Connect(bkey)
+	bval, err := c.options.Marshal(val)
 	if err != nil {
 		return 0, err
 	}
-	defer func(){ if disconnect != nil { disconnect() } }()
-	
-	bval, err := c.options.Marshal(val)
+	return c.checkAndSetBytes(ctx, bkey, bval, oserial, opts)
+}
+
+// CheckAndSet a marshaled value with a marshaled key.
+func (c *Cache) checkAndSetBytes(ctx context.Context, bkey []byte, bval []byte, oserial int64, opts []SetOption) (int64, error) {
+	data, err := c.encodeWith(bkey, bval, opts)
 	if err != nil {
 		return 0, err
 	}
-	nserial := getSerial()
-	resp := util.LuaEval(client, luaForCheckAndSet, 1, bkey, bval, oserial, nserial, c.options.Expiration.Seconds())
-	if resp.Err != nil {
-		return 0, resp.Err
+	return c.checkAndSetData(ctx, bkey, data, oserial, opts)
+}
+
+// CheckAndSet an encoded value with a marshaled key.
+func (c *Cache) checkAndSetData(ctx context.Context, bkey []byte, data []byte, oserial int64, opts []SetOption) (int64, error) {
+	mode, ms, err := c.expiration(opts)
+	if err != nil {
+		return 0, err
 	}
-	if resp.IsType(redis.Nil) {
-		return 0, ErrSetFailed
+	conns := c.connectReplicas(WithWrite(ctx), bkey)
+	defer disconnectAll(conns)
+	primary := firstConnected(conns)
+	if primary == nil {
+		return 0, conns[0].Err
+	}
+
+	nserial, err := c.serial(ctx, primary.Client, opts)
+	if err != nil {
+		return 0, err
+	}
+	depth, floor := c.retention(nserial)
+	tags := c.tags(opts)
+	err = replicate(conns, primary, func(conn *Conn) error {
+		resp := luaEval(ctx, conn.Client, luaForCheckAndSet, 1, bkey, data, oserial, nserial, mode, ms, depth, floor, tags)
+		if resp.Err != nil {
+			return resp.Err
+		}
+		if resp.IsType(redis.Nil) {
+			return ErrSetFailed
+		}
+		return nil
+	}, func(conn *Conn) error {
+		return luaEval(ctx, conn.Client, luaForSet, 1, bkey, data, nserial, mode, ms, depth, floor, tags).Err
+	})
+	if err != nil {
+		return 0, err
 	}
 
 	atomic.AddInt64(&c.loads, 1)
+	c.notify(ctx, [][]byte{bkey}, []int64{nserial})
 	return nserial, nil
 }
 
 // Del remove a cached value for the given key.
 // It takes a key parameter as an interface{} type and performs marshal for it.
+// If the key is replicated, it would be removed from all the replicas.
 func (c *Cache) Del(key interface{}) error {
-	bkey, err := c.options.Marshal(key)
+	return c.DelContext(context.Background(), key)
+}
+
+// DelContext is same with Del, but it returns ctx.Err()
+// as soon as the context is done while connecting or waiting for the reply.
+func (c *Cache) DelContext(ctx context.Context, key interface{}) error {
+	bkey, err := c.marshalKey(key)
 	if err != nil {
 		return err
 	}
-	client, disconnect, _, err := c.connector.Connect(bkey)
+	conns := c.connectReplicas(WithWrite(ctx), bkey)
+	defer disconnectAll(conns)
+	if err := delReplicas(ctx, conns, bkey); err != nil {
+		return err
+	}
+	c.notify(ctx, [][]byte{bkey}, []int64{0})
+	return nil
+}
+
+// Delete the key from all the replicas, returning the first error if any.
+func delReplicas(ctx context.Context, conns []Conn, bkey []byte) error {
+	errs := eachReplica(conns, func(i int, conn *Conn) error {
+		return Roundtrip(ctx, conn.Client, func() *redis.Resp { return conn.Client.Cmd("DEL", bkey) }).Err
+	})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lua script for deleting a cache value only if its newest version has the serial.
+// It returns 1 if deleted or the key does not exist, 0 otherwise.
+const luaForDelIfSerial = luaCurrentFunc +
+	"local cur=current(KEYS[1]) " +
+	"if not cur[1] then " +
+	"  return 1 " +
+	"end " +
+	"if tonumber(cur[2]) ~= tonumber(ARGV[1]) then " +
+	"  return 0 " +
+	"end " +
+	"redis.call('DEL', KEYS[1]) " +
+	"return 1 "
+
+// DelIfSerial removes a cached value for the key, ONLY IF its newest version still has the serial.
+// If a newer value has been stored in the meantime, DelIfSerial would fail with ErrDelFailed.
+// It succeeds for a key which does not exist.
+// If the key is replicated, the primary replica decides, then the others drop versions not newer than the serial.
+func (c *Cache) DelIfSerial(key interface{}, serial int64) error {
+	return c.DelIfSerialContext(context.Background(), key, serial)
+}
+
+// DelIfSerialContext is same with DelIfSerial within the context.
+func (c *Cache) DelIfSerialContext(ctx context.Context, key interface{}, serial int64) error {
+	return c.delWith(ctx, key, luaForDelIfSerial, serial, serial + 1)
+}
+
+// Lua script for deleting versions of a cache value older than the serial.
+// The key would be removed if all of its versions are older.
+// It returns 1 if the newest version is removed or the key does not exist, 0 otherwise.
+const luaForDelOlderThan = luaCurrentFunc +
+	"local cur=current(KEYS[1]) " +
+	"if not cur[1] then " +
+	"  return 1 " +
+	"end " +
+	"if tonumber(cur[2]) < tonumber(ARGV[1]) then " +
+	"  redis.call('DEL', KEYS[1]) " +
+	"  return 1 " +
+	"end " +
+	"if redis.call('TYPE', KEYS[1]).ok == 'zset' then " +
+	"  redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[1]) " +
+	"end " +
+	"return 0 "
+
+// DelOlderThan removes versions of a cached value for the key older than the serial.
+// If the newest version is not older than the serial, it is kept and DelOlderThan fails with ErrDelFailed,
+// so a slow invalidator would not wipe out a fresher value.
+// It succeeds for a key which does not exist.
+// If the key is replicated, the primary replica decides, then the others drop versions older than the serial.
+func (c *Cache) DelOlderThan(key interface{}, serial int64) error {
+	return c.DelOlderThanContext(context.Background(), key, serial)
+}
+
+// DelOlderThanContext is same with DelOlderThan within the context.
+func (c *Cache) DelOlderThanContext(ctx context.Context, key interface{}, serial int64) error {
+	return c.delWith(ctx, key, luaForDelOlderThan, serial, serial)
+}
+
+// Delete a cached value for the key with the conditional script on the primary replica.
+// If succeeded, versions older than the bound are removed from the other replicas,
+// so they would not repair the primary with a deleted value.
+func (c *Cache) delWith(ctx context.Context, key interface{}, script string, serial int64, older int64) error {
+	bkey, err := c.marshalKey(key)
 	if err != nil {
 		return err
 	}
-	defer func(){ if disconnect != nil { disconnect() } }()
-	
-	resp := client.Cmd("DEL", bkey)
-	if resp.Err != nil {
-		return resp.Err
+	conns := c.connectReplicas(WithWrite(ctx), bkey)
+	defer disconnectAll(conns)
+	primary := firstConnected(conns)
+	if primary == nil {
+		return conns[0].Err
 	}
 
+	err = replicate(conns, primary, func(conn *Conn) error {
+		n, err := luaEval(ctx, conn.Client, script, 1, bkey, serial).Int()
+		if err != nil {
+			return err
+		}
+		if n != 1 {
+			return ErrDelFailed
+		}
+		return nil
+	}, func(conn *Conn) error {
+		return luaEval(ctx, conn.Client, luaForDelOlderThan, 1, bkey, older).Err
+	})
+	if err != nil {
+		return err
+	}
+	c.notify(ctx, [][]byte{bkey}, []int64{0})
 	return nil
 }
 
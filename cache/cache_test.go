@@ -1,11 +1,22 @@
 package cache
 
 import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 	
+	"github.com/beatuslapis/gorelib.v0/checker"
 	"github.com/beatuslapis/gorelib.v0/connector"
+	"github.com/beatuslapis/gorelib.v0/connector/cluster"
+
+	"github.com/mediocregopher/radix.v2/redis"
 )
 
 type Key struct {
@@ -18,6 +29,33 @@ type Value struct {
 	Serial int64
 }
 
+// A reader and checker of a single node, which is alive since the given serial
+type sincecheck struct {
+	addr string
+	since int64
+	updates chan checker.ShardStatus
+}
+
+func (s *sincecheck) ReadNodes() []cluster.Shard {
+	return []cluster.Shard{{Name: "server", Addr: s.addr}}
+}
+
+func (s *sincecheck) Start(shards []cluster.Shard) <-chan checker.ShardStatus {
+	s.updates = make(chan checker.ShardStatus)
+	go func() {
+		s.updates <- checker.ShardStatus{
+			Addr: s.addr,
+			Alive: true,
+			Since: s.since,
+		}
+	}()
+	return s.updates
+}
+
+func (s *sincecheck) Stop() {
+	close(s.updates)
+}
+
 func getStored(c *Cache, key interface{}, val interface {}) (interface {}, int64, error) {
 	switch val.(type) {
 	case string:
@@ -227,4 +265,1673 @@ func TestCheckAndSet(t *testing.T) {
 		fmt.Println("incorrect miss counter", misses)
 		t.Fail()
 	}	
-}
\ No newline at end of file
+}
+
+func TestContext(t *testing.T) {
+	key := "contextTest"
+	val := "contextValue:" + time.Now().String()
+
+	connector, err := connector.NewSingle(":6379", 1)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, nil)
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1 * time.Second)
+	defer cancel()
+	if serial, err := cache.SetContext(ctx, key, val); err == nil {
+		fmt.Println("stored for key:{", key, "} with value:{", val, ":", serial, "}")
+	} else {
+		t.Fatal("cache.SetContext failed", err)
+	}
+
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	var stored string
+	if _, err := cache.GetContext(canceled, key, &stored); err != context.Canceled {
+		fmt.Println("unexpected result on a canceled context:", err)
+		t.Fail()
+	}
+
+	if err := cache.DelContext(ctx, key); err != nil {
+		t.Fatal("cache.DelContext failed", err)
+	}
+}
+
+func TestGetOrLoad(t *testing.T) {
+	key := "getOrLoadTest"
+	val := "getOrLoadValue:" + time.Now().String()
+
+	connector, err := connector.NewSingle(":6379", 4)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, nil)
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+	cache.Del(key)
+
+	var nload int32
+	loader := func(key interface{}) (interface{}, error) {
+		atomic.AddInt32(&nload, 1)
+		time.Sleep(100 * time.Millisecond)
+		return val, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var stored string
+			if _, err := cache.GetOrLoad(key, &stored, loader); err != nil {
+				fmt.Println("cache.GetOrLoad failed", err)
+				t.Fail()
+			} else if stored != val {
+				fmt.Println("assert failed. Got:{", stored, "} expected:{", val, "}")
+				t.Fail()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&nload); n != 1 {
+		fmt.Println("incorrect loader calls", n)
+		t.Fail()
+	}
+	if loads := cache.Loads(); loads != 1 {
+		fmt.Println("incorrect load counter", loads)
+		t.Fail()
+	}
+
+	cache.Del(key)
+}
+
+func TestMultiKeys(t *testing.T) {
+	keys := []interface{}{"multiTest1", "multiTest2", Key{"multiTest", 3}}
+	vals := []interface{}{"multiValue1", "multiValue2", "multiValue3"}
+
+	connector, err := connector.NewSingle(":6379", 1)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, nil)
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+
+	if serials, err := cache.MSet(keys, vals); err == nil {
+		fmt.Println("stored for keys:{", keys, "} with serials:{", serials, "}")
+	} else {
+		t.Fatal("cache.MSet failed", err)
+	}
+	if loads := cache.Loads(); loads != 3 {
+		fmt.Println("incorrect load counter", loads)
+		t.Fail()
+	}
+
+	stored := make([]string, len(keys))
+	ptrs := make([]interface{}, len(keys))
+	for i := range stored {
+		ptrs[i] = &stored[i]
+	}
+	if serials, err := cache.MGet(keys, ptrs); err == nil {
+		fmt.Println("stored:{", stored, "} with serials:{", serials, "}")
+		for i := range vals {
+			if stored[i] != vals[i] {
+				fmt.Println("assert failed. Got:{", stored[i], "} expected:{", vals[i], "}")
+				t.Fail()
+			}
+		}
+	} else {
+		t.Fatal("cache.MGet failed", err)
+	}
+
+	if err := cache.MDel(keys[:2]); err != nil {
+		t.Fatal("cache.MDel failed", err)
+	}
+
+	_, err = cache.MGet(keys, ptrs)
+	if errs, ok := err.(MultiError); !ok {
+		fmt.Println("unexpected error:", err)
+		t.Fail()
+	} else if errs[0] != ErrNoKey || errs[1] != ErrNoKey || errs[2] != nil {
+		fmt.Println("unexpected errors:", errs)
+		t.Fail()
+	}
+
+	cache.Del(keys[2])
+}
+
+func TestTypedCache(t *testing.T) {
+	key := Key{"typedTest", 1}
+	val := Value{ Value: "typedValue", Serial: time.Now().Unix()}
+
+	connector, err := connector.NewSingle(":6379", 1)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, nil)
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+	typed := NewTypedCache[Key, Value](cache)
+
+	sserial, err := typed.Set(key, val)
+	if err != nil {
+		t.Fatal("typed.Set failed", err)
+	}
+
+	if stored, serial, err := typed.Get(key); err == nil {
+		fmt.Println("stored:{", stored, "} with serial:{", serial, "}")
+		if stored != val || serial != sserial {
+			fmt.Println("assert failed. Got:{", stored, serial, "} expected:{", val, sserial, "}")
+			t.Fail()
+		}
+	} else {
+		t.Fatal("typed.Get failed", err)
+	}
+
+	if err := typed.Del(key); err != nil {
+		t.Fatal("typed.Del failed", err)
+	}
+	if stored, _, err := typed.Get(key); err != ErrNoKey || stored != (Value{}) {
+		fmt.Println("unexpected result:", stored, err)
+		t.Fail()
+	}
+
+	cache.options.Loader = func(key interface{}) (interface{}, error) {
+		return val, nil
+	}
+	if stored, _, err := typed.GetOrLoad(key, nil); err != nil || stored != val {
+		fmt.Println("unexpected result with the default loader:", stored, err)
+		t.Fail()
+	}
+	typed.Del(key)
+}
+
+func TestSetOptions(t *testing.T) {
+	cache := &Cache{
+		options: &CacheOptions{
+			Expiration: 60 * time.Second,
+			ExpirationJitter: 10 * time.Second,
+		},
+	}
+
+	if mode, ms, err := cache.expiration(nil); err != nil || mode != "px" || ms < 60000 || ms >= 70000 {
+		fmt.Println("unexpected default expiration:", mode, ms, err)
+		t.Fail()
+	}
+	if mode, ms, err := cache.expiration([]SetOption{WithTTL(time.Second)}); err != nil || mode != "px" || ms < 1000 || ms >= 11000 {
+		fmt.Println("unexpected ttl expiration:", mode, ms, err)
+		t.Fail()
+	}
+	if mode, ms, err := cache.expiration([]SetOption{KeepTTL()}); err != nil || mode != "keep" || ms < 60000 {
+		fmt.Println("unexpected keep expiration:", mode, ms, err)
+		t.Fail()
+	}
+	if mode, _, err := cache.expiration([]SetOption{NoExpiry()}); err != nil || mode != "persist" {
+		fmt.Println("unexpected persist expiration:", mode, err)
+		t.Fail()
+	}
+	at := time.Now().Add(time.Hour)
+	if mode, ms, err := cache.expiration([]SetOption{ExpireAt(at)}); err != nil || mode != "pxat" || ms != at.UnixNano() / int64(time.Millisecond) {
+		fmt.Println("unexpected absolute expiration:", mode, ms, err)
+		t.Fail()
+	}
+	if _, _, err := cache.expiration([]SetOption{ExpireAt(time.Now().Add(-time.Second))}); err != ErrExpired {
+		fmt.Println("unexpected error for a past expiration:", err)
+		t.Fail()
+	}
+
+	spread := make(map[int64]bool)
+	for i := 0; i < 10; i++ {
+		_, ms, _ := cache.expiration(nil)
+		spread[ms] = true
+	}
+	if len(spread) < 2 {
+		fmt.Println("jitter is not drawn for each call:", spread)
+		t.Fail()
+	}
+}
+
+func TestVersions(t *testing.T) {
+	key := "versionsTest"
+	vals := []string{"versionsValue1", "versionsValue2"}
+
+	connector, err := connector.NewSingle(":6379", 1)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, nil)
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+	cache.Del(key)
+
+	serials := make([]int64, len(vals))
+	for i, val := range vals {
+		if serial, err := cache.Set(key, val); err == nil {
+			serials[i] = serial
+		} else {
+			t.Fatal("cache.Set failed", err)
+		}
+	}
+
+	if versions, err := cache.GetVersions(key); err == nil {
+		if len(versions) != len(vals) || versions[0].Serial != serials[1] || versions[1].Serial != serials[0] {
+			fmt.Println("unexpected versions:", versions)
+			t.Fail()
+		}
+		var stored string
+		if err := versions[1].Unmarshal(&stored); err != nil || stored != vals[0] {
+			fmt.Println("assert failed. Got:{", stored, err, "} expected:{", vals[0], "}")
+			t.Fail()
+		}
+	} else {
+		t.Fatal("cache.GetVersions failed", err)
+	}
+
+	var stored string
+	if err := cache.GetAt(key, serials[0], &stored); err != nil || stored != vals[0] {
+		fmt.Println("assert failed. Got:{", stored, err, "} expected:{", vals[0], "}")
+		t.Fail()
+	}
+
+	rserial, err := cache.Revert(key, serials[0])
+	if err != nil {
+		t.Fatal("cache.Revert failed", err)
+	}
+	if serial, err := cache.Get(key, &stored); err != nil || stored != vals[0] || serial != rserial {
+		fmt.Println("assert failed. Got:{", stored, serial, err, "} expected:{", vals[0], rserial, "}")
+		t.Fail()
+	}
+
+	cache.Del(key)
+}
+
+func TestRetention(t *testing.T) {
+	cache := &Cache{
+		options: &CacheOptions{},
+	}
+	if depth, floor := cache.retention(1000000); depth != 10 || floor != 0 {
+		fmt.Println("unexpected default retention:", depth, floor)
+		t.Fail()
+	}
+
+	cache.options.HistoryDepth = 1
+	cache.options.MaxVersionAge = 100 * time.Millisecond
+	if depth, floor := cache.retention(1000000); depth != 1 || floor != 900000 {
+		fmt.Println("unexpected retention:", depth, floor)
+		t.Fail()
+	}
+}
+
+func TestHistoryDepth(t *testing.T) {
+	key := "historyDepthTest"
+
+	connector, err := connector.NewSingle(":6379", 2)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	plain, err := NewCache(connector, &CacheOptions{Expiration: 10 * time.Second, HistoryDepth: 1})
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+	sorted, err := NewCache(connector, &CacheOptions{Expiration: 10 * time.Second, HistoryDepth: 3})
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+	plain.Del(key)
+
+	bkey, _ := plain.marshalKey(key)
+	typeOf := func() string {
+		client, disconnect, _, err := connector.Connect(bkey)
+		if err != nil {
+			t.Fatal("can't connect", err)
+		}
+		defer disconnect()
+		typ, _ := client.Cmd("TYPE", bkey).Str()
+		if pttl, _ := client.Cmd("PTTL", bkey).Int64(); pttl <= 0 {
+			fmt.Println("expiration time is lost:", pttl)
+			t.Fail()
+		}
+		return typ
+	}
+
+	serial1, err := plain.Set(key, "v1")
+	if err != nil {
+		t.Fatal("cache.Set failed", err)
+	}
+	serial2, err := plain.CheckAndSet(key, "v2", serial1)
+	if err != nil {
+		t.Fatal("cache.CheckAndSet failed", err)
+	}
+	if typ := typeOf(); typ != "string" {
+		fmt.Println("unexpected storage with the depth 1:", typ)
+		t.Fail()
+	}
+	var stored string
+	if serial, err := plain.Get(key, &stored); err != nil || serial != serial2 || stored != "v2" {
+		fmt.Println("assert failed. Got:{", serial, stored, err, "}")
+		t.Fail()
+	}
+	if versions, err := plain.GetVersions(key); err != nil || len(versions) != 1 || versions[0].Serial != serial2 {
+		fmt.Println("unexpected versions:", versions, err)
+		t.Fail()
+	}
+	if err := plain.GetAt(key, serial1, &stored); err != ErrNoKey {
+		fmt.Println("unexpected error for a dropped version:", err)
+		t.Fail()
+	}
+
+	serial3, err := sorted.Set(key, "v3")
+	if err != nil {
+		t.Fatal("cache.Set failed", err)
+	}
+	if typ := typeOf(); typ != "zset" {
+		fmt.Println("plain value is not converted:", typ)
+		t.Fail()
+	}
+	if err := sorted.GetAt(key, serial2, &stored); err != nil || stored != "v2" {
+		fmt.Println("assert failed for a converted version. Got:{", stored, err, "}")
+		t.Fail()
+	}
+
+	serial4, err := plain.Revert(key, serial2)
+	if err != nil {
+		t.Fatal("cache.Revert failed", err)
+	}
+	if typ := typeOf(); typ != "string" {
+		fmt.Println("sorted set is not converted:", typ)
+		t.Fail()
+	}
+	if _, err := plain.Get(key, &stored); err != nil || stored != "v2" {
+		fmt.Println("assert failed for a reverted value. Got:{", stored, err, "}")
+		t.Fail()
+	}
+	if err := plain.DelOlderThan(key, serial3); err != ErrDelFailed {
+		fmt.Println("unexpected error for a newer value:", err)
+		t.Fail()
+	}
+	if err := plain.DelOlderThan(key, serial4 + 1); err != nil {
+		fmt.Println("cache.DelOlderThan failed", err)
+		t.Fail()
+	}
+	if _, err := plain.Get(key, &stored); err != ErrNoKey {
+		fmt.Println("unexpected error for a deleted value:", err)
+		t.Fail()
+	}
+}
+
+func TestCompression(t *testing.T) {
+	cache := &Cache{
+		options: &CacheOptions{
+			CompressThreshold: 64,
+		},
+	}
+	bkey := []byte("compressionTest")
+
+	small := []byte("small value")
+	large := bytes.Repeat([]byte("compressible "), 100)
+	escaped := []byte{0x00, 'Z', 'x'}
+	for _, bval := range [][]byte{small, large, escaped} {
+		data, err := cache.encode(bkey, bval)
+		if err != nil {
+			t.Fatal("encode failed", err)
+		}
+		fmt.Println("encoded", len(bval), "bytes into", len(data), "bytes")
+		if decoded, err := cache.decode(bkey, data); err != nil || !bytes.Equal(decoded, bval) {
+			fmt.Println("assert failed. Got:{", decoded, err, "} expected:{", bval, "}")
+			t.Fail()
+		}
+	}
+
+	if data, _ := cache.encode(bkey, large); len(data) >= len(large) || headerOf(data) != headerCompressed {
+		fmt.Println("large value is not compressed")
+		t.Fail()
+	}
+	if data, _ := cache.encode(bkey, small); !bytes.Equal(data, small) {
+		fmt.Println("small value is encoded:", data)
+		t.Fail()
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	keyring := NewKeyring()
+	if err := keyring.Add(1, bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal("keyring.Add failed", err)
+	}
+	cache := &Cache{
+		options: &CacheOptions{
+			CompressThreshold: 64,
+			Keyring: keyring,
+		},
+	}
+	bkey := []byte("encryptionTest")
+	bval := bytes.Repeat([]byte("secret "), 100)
+
+	old, err := cache.encode(bkey, bval)
+	if err != nil {
+		t.Fatal("encode failed", err)
+	}
+	if bytes.Contains(old, []byte("secret")) {
+		fmt.Println("value is not encrypted")
+		t.Fail()
+	}
+
+	// rotation
+	keyring.Add(2, bytes.Repeat([]byte{2}, 32))
+	keyring.Use(2)
+	cur, _ := cache.encode(bkey, bval)
+	for _, data := range [][]byte{old, cur} {
+		if decoded, err := cache.decode(bkey, data); err != nil || !bytes.Equal(decoded, bval) {
+			fmt.Println("assert failed. Got:{", decoded, err, "}")
+			t.Fail()
+		}
+	}
+
+	// authentication failures
+	if _, err := cache.decode([]byte("anotherKey"), cur); err != ErrDecrypt {
+		fmt.Println("unexpected error for another key:", err)
+		t.Fail()
+	}
+	cur[len(cur) - 1] ^= 0xff
+	if _, err := cache.decode(bkey, cur); err != ErrDecrypt {
+		fmt.Println("unexpected error for a tampered value:", err)
+		t.Fail()
+	}
+	if _, err := cache.decode(bkey, bval); err != ErrDecrypt {
+		fmt.Println("unexpected error for a plain value:", err)
+		t.Fail()
+	}
+	keyring.Remove(1)
+	if _, err := cache.decode(bkey, old); err != ErrUnknownKeyID {
+		fmt.Println("unexpected error for a removed key:", err)
+		t.Fail()
+	}
+}
+
+func TestSoftExpiration(t *testing.T) {
+	key := "softExpirationTest"
+	val := "softExpirationValue:" + time.Now().String()
+
+	var nload int32
+	release := make(chan struct{})
+	connector, err := connector.NewSingle(":6379", 2)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, &CacheOptions{
+		Expiration: 10 * time.Second,
+		SoftExpiration: 100 * time.Millisecond,
+		Loader: func(key interface{}) (interface{}, error) {
+			atomic.AddInt32(&nload, 1)
+			<-release
+			return val, nil
+		},
+	})
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+
+	sserial, err := cache.Set(key, val)
+	if err != nil {
+		t.Fatal("cache.Set failed", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	var stored string
+	for i := 0; i < 4; i++ {
+		if serial, stale, err := cache.GetWithStale(key, &stored); err != nil || serial != sserial || !stale {
+			fmt.Println("unexpected result for a stale value:", serial, stale, err)
+			t.Fail()
+		}
+	}
+	close(release)
+	for i := 0; i < 20; i++ {
+		if serial, err := cache.Get(key, &stored); err == nil && serial != sserial {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&nload); n != 1 {
+		fmt.Println("incorrect loader calls", n)
+		t.Fail()
+	}
+	if serial, stale, err := cache.GetWithStale(key, &stored); err != nil || serial <= sserial || stale {
+		fmt.Println("unexpected result for a refreshed value:", serial, stale, err)
+		t.Fail()
+	}
+
+	cache.Del(key)
+	if _, err := cache.SetWithSerial(key, val, 5); err != nil {
+		t.Fatal("cache.SetWithSerial failed", err)
+	}
+	if serial, stale, err := cache.GetWithStale(key, &stored); err != nil || serial != 5 || stale {
+		fmt.Println("unexpected result for a value with a caller serial:", serial, stale, err)
+		t.Fail()
+	}
+
+	cache.Del(key)
+}
+
+func TestLoaderPanic(t *testing.T) {
+	var f flight
+	release := make(chan struct{})
+	started := f.start("loaderPanicTest", func() ([]byte, int64, error) {
+		<-release
+		panic("loader panic")
+	})
+	if !started {
+		t.Fatal("refresh is not started")
+	}
+
+	f.mx.Lock()
+	cl := f.calls["loaderPanicTest"]
+	f.mx.Unlock()
+	close(release)
+
+	<-cl.done
+	if err := cl.err; !errors.Is(err, ErrLoaderPanic) {
+		fmt.Println("unexpected error for a panicked loader:", err)
+		t.Fail()
+	}
+	if _, _, err := f.do(context.Background(), "loaderPanicTest", func() ([]byte, int64, error) {
+		panic("loader panic")
+	}); !errors.Is(err, ErrLoaderPanic) {
+		fmt.Println("unexpected error for a panicked loader:", err)
+		t.Fail()
+	}
+}
+
+func TestEarlyRecompute(t *testing.T) {
+	cache := &Cache{
+		options: &CacheOptions{
+			EarlyRecompute: 1.0,
+		},
+	}
+	bkey := []byte("earlyRecomputeTest")
+	bval := []byte("earlyRecomputeValue")
+
+	data, err := cache.encodeWith(bkey, bval, []SetOption{withCost(50 * time.Millisecond)})
+	if err != nil {
+		t.Fatal("encode failed", err)
+	}
+	if cost := costOf(data); cost != 50 * time.Millisecond {
+		fmt.Println("unexpected cost:", cost)
+		t.Fail()
+	}
+	if decoded, err := cache.decode(bkey, data); err != nil || !bytes.Equal(decoded, bval) {
+		fmt.Println("assert failed. Got:{", decoded, err, "}")
+		t.Fail()
+	}
+
+	count := func(ttl time.Duration) int {
+		n := 0
+		for i := 0; i < 1000; i++ {
+			if cache.recomputeEarly(item{ttl: ttl, cost: 50 * time.Millisecond}) {
+				n++
+			}
+		}
+		return n
+	}
+	far, near := count(time.Hour), count(10 * time.Millisecond)
+	fmt.Println("early recomputations far:", far, "near:", near)
+	if far != 0 || near < 500 {
+		t.Fail()
+	}
+	if cache.recomputeEarly(item{ttl: -time.Millisecond, cost: time.Second}) {
+		fmt.Println("persistent value is recomputed")
+		t.Fail()
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	key := "negativeCachingTest"
+	val := "negativeCachingValue:" + time.Now().String()
+
+	var nload int32
+	connector, err := connector.NewSingle(":6379", 2)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, &CacheOptions{
+		Expiration: 10 * time.Second,
+		NegativeExpiration: time.Second,
+	})
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+	cache.Del(key)
+
+	loader := func(key interface{}) (interface{}, error) {
+		atomic.AddInt32(&nload, 1)
+		return nil, ErrNotFound
+	}
+	var stored string
+	nserial, err := cache.GetOrLoad(key, &stored, loader)
+	if err != ErrNegative || nserial == 0 {
+		fmt.Println("unexpected result for an absent entity:", nserial, err)
+		t.Fail()
+	}
+	for i := 0; i < 3; i++ {
+		if serial, err := cache.GetOrLoad(key, &stored, loader); err != ErrNegative || serial != nserial {
+			fmt.Println("unexpected result for a tombstone:", serial, err)
+			t.Fail()
+		}
+	}
+	if n := atomic.LoadInt32(&nload); n != 1 {
+		fmt.Println("incorrect loader calls", n)
+		t.Fail()
+	}
+
+	sserial, err := cache.Set(key, val)
+	if err != nil || sserial <= nserial {
+		t.Fatal("cache.Set failed", sserial, err)
+	}
+	if serial, err := cache.Get(key, &stored); err != nil || serial != sserial || stored != val {
+		fmt.Println("tombstone is not overridden:", serial, err, stored)
+		t.Fail()
+	}
+
+	if _, err := cache.SetNegative(key); err != nil {
+		t.Fatal("cache.SetNegative failed", err)
+	}
+	if _, err := cache.Get(key, &stored); err != ErrNegative {
+		fmt.Println("unexpected error for a tombstone:", err)
+		t.Fail()
+	}
+
+	cache.Del(key)
+}
+
+func TestTags(t *testing.T) {
+	keys := []string{"tagsTest1", "tagsTest2", "tagsTest3"}
+	val := "tagsValue:" + time.Now().String()
+
+	connector, err := connector.NewSingle(":6379", 2)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, nil)
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+
+	if _, err := cache.Set(keys[0], val, WithTags("user:42", "tenant:7")); err != nil {
+		t.Fatal("cache.Set failed", err)
+	}
+	if _, err := cache.Set(keys[1], val, WithTags("user:42")); err != nil {
+		t.Fatal("cache.Set failed", err)
+	}
+	if _, err := cache.Set(keys[2], val, WithTags("tenant:7")); err != nil {
+		t.Fatal("cache.Set failed", err)
+	}
+
+	var stored string
+	for _, key := range keys {
+		if _, err := cache.Get(key, &stored); err != nil || stored != val {
+			fmt.Println("assert failed. Got:{", stored, err, "}")
+			t.Fail()
+		}
+	}
+
+	if err := cache.InvalidateTag("user:42"); err != nil {
+		t.Fatal("cache.InvalidateTag failed", err)
+	}
+	for i, key := range keys {
+		_, err := cache.Get(key, &stored)
+		if i < 2 && !errors.Is(err, ErrInvalidated) {
+			fmt.Println("unexpected error for an invalidated key:", key, err)
+			t.Fail()
+		}
+		if i == 2 && err != nil {
+			fmt.Println("unexpected error for a valid key:", key, err)
+			t.Fail()
+		}
+	}
+
+	if _, err := cache.Set(keys[0], val, WithTags("user:42")); err != nil {
+		t.Fatal("cache.Set failed", err)
+	}
+	if _, err := cache.Get(keys[0], &stored); err != nil || stored != val {
+		fmt.Println("assert failed for a value set after invalidation. Got:{", stored, err, "}")
+		t.Fail()
+	}
+
+	for _, key := range keys {
+		cache.Del(key)
+	}
+}
+
+func TestRefreshTags(t *testing.T) {
+	keys := []string{"refreshTagsTest1", "refreshTagsTest2"}
+	val := "refreshTagsValue:" + time.Now().String()
+
+	var nload int32
+	connector, err := connector.NewSingle(":6379", 2)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, &CacheOptions{
+		Expiration: 10 * time.Second,
+		SoftExpiration: 100 * time.Millisecond,
+		Loader: func(key interface{}) (interface{}, error) {
+			atomic.AddInt32(&nload, 1)
+			return val, nil
+		},
+	})
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+
+	var stored string
+	if _, err := cache.GetOrLoad(keys[0], &stored, nil, WithTags("refresh:1")); err != nil || stored != val {
+		fmt.Println("assert failed for a loaded value. Got:{", stored, err, "}")
+		t.Fail()
+	}
+
+	sserial, err := cache.Set(keys[1], val, WithTags("refresh:1"))
+	if err != nil {
+		t.Fatal("cache.Set failed", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if serial, err := cache.Get(keys[1], &stored); err != nil || serial != sserial {
+		fmt.Println("unexpected result for a stale value:", serial, err)
+		t.Fail()
+	}
+	for i := 0; i < 20; i++ {
+		if serial, err := cache.Get(keys[1], &stored); err == nil && serial != sserial {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&nload); n != 2 {
+		fmt.Println("incorrect loader calls", n)
+		t.Fail()
+	}
+
+	if err := cache.InvalidateTag("refresh:1"); err != nil {
+		t.Fatal("cache.InvalidateTag failed", err)
+	}
+	for _, key := range keys {
+		if _, err := cache.Get(key, &stored); !errors.Is(err, ErrInvalidated) {
+			fmt.Println("unexpected error for an invalidated key:", key, err)
+			t.Fail()
+		}
+	}
+
+	for _, key := range keys {
+		cache.Del(key)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	key := "namespaceTest"
+	val := "namespaceValue:" + time.Now().String()
+
+	connector, err := connector.NewSingle(":6379", 2)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, nil)
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+	orders, users := cache.Namespace("orders"), cache.Namespace("users")
+
+	if _, err := orders.Set(key, "orders:" + val); err != nil {
+		t.Fatal("orders.Set failed", err)
+	}
+	if _, err := users.Set(key, "users:" + val); err != nil {
+		t.Fatal("users.Set failed", err)
+	}
+	if _, err := cache.Set(key, val); err != nil {
+		t.Fatal("cache.Set failed", err)
+	}
+
+	var stored string
+	if _, err := orders.Get(key, &stored); err != nil || stored != "orders:" + val {
+		fmt.Println("assert failed. Got:{", stored, err, "}")
+		t.Fail()
+	}
+
+	if err := orders.Flush(); err != nil {
+		t.Fatal("orders.Flush failed", err)
+	}
+	if _, err := orders.Get(key, &stored); !errors.Is(err, ErrInvalidated) {
+		fmt.Println("unexpected error for a flushed namespace:", err)
+		t.Fail()
+	}
+	if _, err := users.Get(key, &stored); err != nil || stored != "users:" + val {
+		fmt.Println("other namespace is affected. Got:{", stored, err, "}")
+		t.Fail()
+	}
+	if _, err := cache.Get(key, &stored); err != nil || stored != val {
+		fmt.Println("key out of namespaces is affected. Got:{", stored, err, "}")
+		t.Fail()
+	}
+
+	orders.Del(key)
+	users.Del(key)
+	cache.Del(key)
+}
+
+func TestHybridClock(t *testing.T) {
+	clock := &HybridClock{}
+	ctx := context.Background()
+
+	last, _ := clock.Serial(ctx, nil)
+	for i := 0; i < 1000; i++ {
+		serial, err := clock.Serial(ctx, nil)
+		if err != nil || serial <= last {
+			fmt.Println("serial goes backward:", last, serial, err)
+			t.Fail()
+		}
+		last = serial
+	}
+
+	future := last + int64(time.Hour / time.Microsecond)
+	clock.Observe(future)
+	if serial, _ := clock.Serial(ctx, nil); serial <= future {
+		fmt.Println("serial is not newer than the observed one:", future, serial)
+		t.Fail()
+	}
+	clock.Observe(last)
+	if serial, _ := clock.Serial(ctx, nil); serial <= future {
+		fmt.Println("serial goes backward by an older observation:", future, serial)
+		t.Fail()
+	}
+}
+
+func TestSetWithSerial(t *testing.T) {
+	key := "setWithSerialTest"
+
+	connector, err := connector.NewSingle(":6379", 2)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, nil)
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+	cache.Del(key)
+
+	if serial, err := cache.SetWithSerial(key, "version 5", 5); err != nil || serial != 5 {
+		t.Fatal("cache.SetWithSerial failed", serial, err)
+	}
+	if _, err := cache.SetWithSerial(key, "version 3", 3); err != ErrSetFailed {
+		fmt.Println("out-of-order write is not rejected:", err)
+		t.Fail()
+	}
+	if _, err := cache.CheckAndSetWithSerial(key, "version 7", 4, 7); err != ErrSetFailed {
+		fmt.Println("CheckAndSet with an old serial is not rejected:", err)
+		t.Fail()
+	}
+	if serial, err := cache.CheckAndSetWithSerial(key, "version 7", 5, 7); err != nil || serial != 7 {
+		fmt.Println("cache.CheckAndSetWithSerial failed", serial, err)
+		t.Fail()
+	}
+
+	var stored string
+	if serial, err := cache.Get(key, &stored); err != nil || serial != 7 || stored != "version 7" {
+		fmt.Println("assert failed. Got:{", serial, stored, err, "}")
+		t.Fail()
+	}
+	if _, err := cache.SetWithSerial(key, "version 0", 0); err != ErrInvalidSerial {
+		fmt.Println("unexpected error for an invalid serial:", err)
+		t.Fail()
+	}
+
+	cache.Del(key)
+}
+
+func TestSetWithSerialSince(t *testing.T) {
+	key := "setWithSerialSinceTest"
+
+	check := &sincecheck{
+		addr: ":6379",
+		since: time.Now().UnixNano() / 1000,
+	}
+	cl, err := connector.NewCluster(&connector.ClusterOptions{
+		Reader: check,
+		Builder: &cluster.ConsistentRing{
+			Nreplica: 3,
+		},
+		Checker: check,
+	})
+	if err != nil {
+		t.Fatal("can't create a cluster:", err)
+	}
+	defer cl.Shutdown()
+	time.Sleep(50 * time.Millisecond)
+
+	cache, err := NewCache(cl, nil)
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+	cache.Del(key)
+
+	if serial, err := cache.SetWithSerial(key, "version 5", 5); err != nil || serial != 5 {
+		t.Fatal("cache.SetWithSerial failed", serial, err)
+	}
+	if serial, err := cache.SetWithSerial(key, "version 7", 7); err != nil || serial != 7 {
+		t.Fatal("cache.SetWithSerial failed", serial, err)
+	}
+
+	var stored string
+	if serial, err := cache.Get(key, &stored); err != nil || serial != 7 || stored != "version 7" {
+		fmt.Println("assert failed. Got:{", serial, stored, err, "}")
+		t.Fail()
+	}
+	if versions, err := cache.GetVersions(key); err != nil || len(versions) != 2 {
+		fmt.Println("unexpected versions:", versions, err)
+		t.Fail()
+	}
+	if err := cache.GetAt(key, 5, &stored); err != nil || stored != "version 5" {
+		fmt.Println("assert failed for a version. Got:{", stored, err, "}")
+		t.Fail()
+	}
+	scanner := cache.Scan(`"` + key + `"`)
+	if !scanner.Next() || scanner.Serial() != 7 {
+		fmt.Println("the value is not scanned:", scanner.Err())
+		t.Fail()
+	}
+	if serial, err := cache.Revert(key, 5); err != nil || serial <= 7 {
+		fmt.Println("cache.Revert failed", serial, err)
+		t.Fail()
+	}
+	if _, err := cache.Get(key, &stored); err != nil || stored != "version 5" {
+		fmt.Println("assert failed for a reverted value. Got:{", stored, err, "}")
+		t.Fail()
+	}
+
+	cache.Del(key)
+}
+
+func TestConditionalDel(t *testing.T) {
+	key := "conditionalDelTest"
+
+	connector, err := connector.NewSingle(":6379", 2)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, nil)
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+	cache.Del(key)
+
+	oserial, err := cache.Set(key, "old")
+	if err != nil {
+		t.Fatal("cache.Set failed", err)
+	}
+	nserial, err := cache.Set(key, "new")
+	if err != nil {
+		t.Fatal("cache.Set failed", err)
+	}
+
+	if err := cache.DelIfSerial(key, oserial); err != ErrDelFailed {
+		fmt.Println("fresher value is deleted by DelIfSerial:", err)
+		t.Fail()
+	}
+	if err := cache.DelOlderThan(key, nserial); err != ErrDelFailed {
+		fmt.Println("fresher value is deleted by DelOlderThan:", err)
+		t.Fail()
+	}
+	if err := cache.GetAt(key, oserial, new(string)); err != ErrNoKey {
+		fmt.Println("older version is not removed by DelOlderThan:", err)
+		t.Fail()
+	}
+
+	var stored string
+	if serial, err := cache.Get(key, &stored); err != nil || serial != nserial || stored != "new" {
+		fmt.Println("assert failed. Got:{", serial, stored, err, "}")
+		t.Fail()
+	}
+
+	if err := cache.DelIfSerial(key, nserial); err != nil {
+		fmt.Println("cache.DelIfSerial failed", err)
+		t.Fail()
+	}
+	if _, err := cache.Get(key, &stored); err != ErrNoKey {
+		fmt.Println("unexpected error for a deleted key:", err)
+		t.Fail()
+	}
+	if err := cache.DelOlderThan(key, nserial); err != nil {
+		fmt.Println("unexpected error for an absent key:", err)
+		t.Fail()
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	key := "updateTest"
+
+	connector, err := connector.NewSingle(":6379", 8)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, &CacheOptions{
+		Expiration: 10 * time.Second,
+		UpdateRetries: 100,
+		UpdateBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+	cache.Del(key)
+
+	typed := NewTypedCache[string, int](cache)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_, _, err := typed.Update(key, func(old *int) (int, error) {
+					if old == nil {
+						return 1, nil
+					}
+					return *old + 1, nil
+				})
+				if err != nil {
+					fmt.Println("typed.Update failed", err)
+					t.Fail()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if stored, _, err := typed.Get(key); err != nil || stored != 80 {
+		fmt.Println("lost updates. Got:{", stored, err, "}")
+		t.Fail()
+	}
+
+	errAbort := fmt.Errorf("abort")
+	if _, _, err := typed.Update(key, func(old *int) (int, error) { return 0, errAbort }); err != errAbort {
+		fmt.Println("unexpected error for an aborted update:", err)
+		t.Fail()
+	}
+
+	cache.Del(key)
+}
+
+func TestUpdateRetry(t *testing.T) {
+	key := "updateRetryTest"
+
+	connector, err := connector.NewSingle(":6379", 2)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, &CacheOptions{
+		Expiration: 10 * time.Second,
+		UpdateRetries: 3,
+		UpdateBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+	cache.Del(key)
+
+	typed := NewTypedCache[string, map[string]int](cache)
+	if _, err := typed.Set(key, map[string]int{"a": 1}); err != nil {
+		t.Fatal("typed.Set failed", err)
+	}
+
+	attempts := 0
+	stored, _, err := typed.Update(key, func(old *map[string]int) (map[string]int, error) {
+		attempts++
+		if attempts == 1 {
+			// A conflicting write removing the entry
+			if _, err := typed.Set(key, map[string]int{"b": 2}); err != nil {
+				return nil, err
+			}
+		}
+		nval := map[string]int{"c": 3}
+		for k, v := range *old {
+			nval[k] = v
+		}
+		return nval, nil
+	})
+	if err != nil || attempts != 2 {
+		fmt.Println("typed.Update failed", attempts, err)
+		t.Fail()
+	}
+	if !reflect.DeepEqual(stored, map[string]int{"b": 2, "c": 3}) {
+		fmt.Println("leftovers of the conflicted attempt. Got:{", stored, "}")
+		t.Fail()
+	}
+
+	cache.Del(key)
+}
+
+func TestUpdateInvalidated(t *testing.T) {
+	key := "updateInvalidatedTest"
+
+	connector, err := connector.NewSingle(":6379", 2)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, &CacheOptions{
+		Expiration: 10 * time.Second,
+		UpdateRetries: 3,
+	})
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+	cache.Del(key)
+
+	if _, err := cache.Set(key, 1, WithTags("updateInvalidatedTag")); err != nil {
+		t.Fatal("cache.Set failed", err)
+	}
+	if err := cache.InvalidateTag("updateInvalidatedTag"); err != nil {
+		t.Fatal("cache.InvalidateTag failed", err)
+	}
+
+	var stored int
+	serial, err := cache.Update(key, &stored, func(old interface{}) (interface{}, error) {
+		if old != nil {
+			return 0, fmt.Errorf("invalidated value is given: %v", old)
+		}
+		return 100, nil
+	})
+	if err != nil || serial == 0 {
+		fmt.Println("Update failed for an invalidated key:", serial, err)
+		t.Fail()
+	}
+	if _, err := cache.Get(key, &stored); err != nil || stored != 100 {
+		fmt.Println("assert failed. Got:{", stored, err, "}")
+		t.Fail()
+	}
+
+	cache.Del(key)
+}
+
+func TestMissError(t *testing.T) {
+	cache := &Cache{
+		options: &CacheOptions{},
+	}
+
+	var stored string
+	reply := redis.NewResp([]interface{}{"stale", 1000})
+	_, err := cache.unmarshalGet(nil, reply, 2000, &stored)
+	var miss *MissError
+	if !errors.Is(err, ErrNoKey) || !errors.Is(err, ErrStale) || errors.Is(err, ErrInvalidated) {
+		fmt.Println("unexpected error for a stale value:", err)
+		t.Fail()
+	} else if !errors.As(err, &miss) || miss.Serial != 1000 || miss.ValidSince != 2000 {
+		fmt.Println("unexpected miss:", miss)
+		t.Fail()
+	}
+
+	reply = redis.NewResp([]interface{}{"invalidated", 3000})
+	if _, err := cache.unmarshalGet(nil, reply, 2000, &stored); !errors.Is(err, ErrNoKey) || !errors.Is(err, ErrInvalidated) {
+		fmt.Println("unexpected error for an invalidated value:", err)
+		t.Fail()
+	}
+	if _, err := cache.unmarshalGet(nil, redis.NewResp(nil), 2000, &stored); err != ErrNoKey {
+		fmt.Println("unexpected error for an absent key:", err)
+		t.Fail()
+	}
+	if misses := cache.Misses(); misses != 3 {
+		fmt.Println("incorrect misses", misses)
+		t.Fail()
+	}
+}
+
+func TestGetMinSerial(t *testing.T) {
+	key := "getMinSerialTest"
+
+	connector, err := connector.NewSingle(":6379", 2)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, nil)
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+	cache.Del(key)
+
+	if _, err := cache.SetWithSerial(key, "version 5", 5); err != nil {
+		t.Fatal("cache.SetWithSerial failed", err)
+	}
+
+	var stored string
+	if serial, err := cache.GetMinSerial(key, &stored, 5); err != nil || serial != 5 || stored != "version 5" {
+		fmt.Println("assert failed. Got:{", serial, stored, err, "}")
+		t.Fail()
+	}
+	_, err = cache.GetMinSerial(key, &stored, 6)
+	var miss *MissError
+	if !errors.Is(err, ErrBehind) || !errors.Is(err, ErrNoKey) || !errors.As(err, &miss) || miss.Serial != 5 {
+		fmt.Println("unexpected error for an older value:", err)
+		t.Fail()
+	}
+
+	cache.Del(key)
+}
+
+func TestNearCacheEntries(t *testing.T) {
+	near := &NearCache{
+		options: NearOptions{
+			Size: 2,
+			Expiration: time.Second,
+		},
+		lru: list.New(),
+		entries: make(map[string]*list.Element),
+	}
+
+	near.store(&nearEntry{bkey: "a", serial: 10}, near.epoch("a"))
+	near.store(&nearEntry{bkey: "b", serial: 10}, near.epoch("b"))
+	near.lookup("a")
+	near.store(&nearEntry{bkey: "c", serial: 10}, near.epoch("c"))
+	if _, ok := near.lookup("b"); ok {
+		fmt.Println("least recently used entry is not evicted")
+		t.Fail()
+	}
+	if _, ok := near.lookup("a"); !ok {
+		fmt.Println("recently used entry is evicted")
+		t.Fail()
+	}
+
+	near.invalidate("5 a")
+	if _, ok := near.lookup("a"); !ok {
+		fmt.Println("entry is evicted by an older serial")
+		t.Fail()
+	}
+	near.invalidate("11 a")
+	if _, ok := near.lookup("a"); ok {
+		fmt.Println("entry is not evicted by a newer serial")
+		t.Fail()
+	}
+	near.invalidate("0 c")
+	if _, ok := near.lookup("c"); ok {
+		fmt.Println("entry is not evicted by a deletion")
+		t.Fail()
+	}
+
+	epoch := near.epoch("d")
+	near.invalidate("20 d")
+	near.store(&nearEntry{bkey: "d", serial: 10}, epoch)
+	if _, ok := near.lookup("d"); ok {
+		fmt.Println("entry fetched before an invalidation is stored")
+		t.Fail()
+	}
+}
+
+func TestNearCachePublish(t *testing.T) {
+	keys := []string{"nearPublishTest1", "nearPublishTest2"}
+
+	newNear := func() (*Cache, *NearCache) {
+		connector, err := connector.NewSingle(":6379", 2)
+		if err != nil {
+			t.Fatal("can't create connector")
+		}
+		cache, err := NewCache(connector, nil)
+		if err != nil {
+			t.Fatal("can't create cache")
+		}
+		near, err := NewNearCache(cache, &NearOptions{Channel: "gorelib:nearPublishTest"})
+		if err != nil {
+			t.Fatal("can't create near cache", err)
+		}
+		return cache, near
+	}
+	writer, wnear := newNear()
+	defer wnear.Shutdown()
+	_, reader := newNear()
+	defer reader.Shutdown()
+	time.Sleep(50 * time.Millisecond)
+
+	// Read both keys into the near cache of the reader, then check a write by the writer is seen
+	check := func(what string, write func() error, expected []string) {
+		var stored string
+		for _, key := range keys {
+			reader.Get(key, &stored)
+		}
+		if err := write(); err != nil {
+			t.Fatal(what, "failed", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		for i, key := range keys {
+			stored = ""
+			reader.Get(key, &stored)
+			if stored != expected[i] {
+				fmt.Println("stale near cache entry after", what, "Got:{", stored, "} expected:{", expected[i], "}")
+				t.Fail()
+			}
+		}
+	}
+
+	if _, err := writer.MSet([]interface{}{keys[0], keys[1]}, []interface{}{"v1", "v1"}, WithTags("nearPublish")); err != nil {
+		t.Fatal("cache.MSet failed", err)
+	}
+	check("MSet", func() error {
+		_, err := writer.MSet([]interface{}{keys[0], keys[1]}, []interface{}{"v2", "v2"}, WithTags("nearPublish"))
+		return err
+	}, []string{"v2", "v2"})
+	check("Update", func() error {
+		var val string
+		_, err := writer.Update(keys[0], &val, func(interface{}) (interface{}, error) { return "v3", nil }, WithTags("nearPublish"))
+		return err
+	}, []string{"v3", "v2"})
+	check("InvalidateTag", func() error {
+		return writer.InvalidateTag("nearPublish")
+	}, []string{"", ""})
+	if _, err := writer.Set(keys[0], "v4"); err != nil {
+		t.Fatal("cache.Set failed", err)
+	}
+	check("MDel", func() error {
+		return writer.MDel([]interface{}{keys[0]})
+	}, []string{"", ""})
+
+	writer.MDel([]interface{}{keys[0], keys[1]})
+}
+
+type memStore struct {
+	mx sync.Mutex
+	vals map[interface{}]interface{}
+	saves int
+}
+
+func (s *memStore) Load(key interface{}) (interface{}, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if val, ok := s.vals[key]; ok {
+		return val, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memStore) Save(key interface{}, val interface{}, serial int64) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.vals[key] = val
+	s.saves++
+	return nil
+}
+
+func (s *memStore) Delete(key interface{}) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.vals, key)
+	return nil
+}
+
+func TestWriteBehindCoalescing(t *testing.T) {
+	cache := &Cache{
+		options: &CacheOptions{
+			Marshal: defaultMarshal,
+			Unmarshal: defaultUnmarshal,
+		},
+	}
+	store := &memStore{vals: make(map[interface{}]interface{})}
+	wb := NewWriteBehind(cache, store, &WriteBehindOptions{
+		Interval: time.Hour,
+	})
+
+	wb.enqueue(pendingSet("a", "a2", 2))
+	wb.enqueue(pendingSet("a", "a1", 1))
+	wb.enqueue(pendingSet("a", "a3", 3))
+	wb.enqueue(pendingSet("b", "b1", 1))
+	wb.enqueue(&pendingWrite{key: "b", del: true})
+	wb.enqueue(pendingSet("c", "c1", 1))
+
+	if pw, ok := wb.lookup("a"); !ok || pw.serial != 3 {
+		fmt.Println("pending writes are not coalesced:", pw)
+		t.Fail()
+	}
+	wb.Shutdown()
+
+	if store.saves != 2 || store.vals["a"] != "a3" || store.vals["c"] != "c1" {
+		fmt.Println("unexpected store:", store.saves, store.vals)
+		t.Fail()
+	}
+	if _, ok := store.vals["b"]; ok {
+		fmt.Println("deleted key is saved")
+		t.Fail()
+	}
+}
+
+// A pending write of a value, marshaled like WriteBehind.Set
+func pendingSet(key string, val interface{}, serial int64) *pendingWrite {
+	bval, _ := defaultMarshal(val)
+	return &pendingWrite{key: key, bval: bval, typ: reflect.TypeOf(val), serial: serial}
+}
+
+// A Store blocking saves until released
+type blockingStore struct {
+	memStore
+	saving chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Save(key interface{}, val interface{}, serial int64) error {
+	s.saving <- struct{}{}
+	<-s.release
+	return s.memStore.Save(key, val, serial)
+}
+
+func TestWriteBehindFlush(t *testing.T) {
+	cache := &Cache{
+		options: &CacheOptions{
+			Marshal: defaultMarshal,
+			Unmarshal: defaultUnmarshal,
+		},
+	}
+	store := &blockingStore{
+		memStore: memStore{vals: make(map[interface{}]interface{})},
+		saving: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	wb := NewWriteBehind(cache, store, &WriteBehindOptions{
+		Interval: time.Hour,
+		BatchSize: 1,
+	})
+
+	wb.enqueue(pendingSet("a", map[string]int{"n": 1}, 1))
+	<-store.saving
+	if pw, ok := wb.lookup("a"); !ok || pw.serial != 1 {
+		fmt.Println("write being flushed is not pending:", pw)
+		t.Fail()
+	}
+	wb.enqueue(pendingSet("a", map[string]int{"n": 3}, 2))
+	store.release <- struct{}{}
+
+	<-store.saving
+	store.release <- struct{}{}
+	go func() {
+		for range store.saving {
+			store.release <- struct{}{}
+		}
+	}()
+	wb.Shutdown()
+	close(store.saving)
+
+	if saved, ok := store.vals["a"].(map[string]int); !ok || saved["n"] != 3 {
+		fmt.Println("unexpected store:", store.vals)
+		t.Fail()
+	}
+	if _, ok := wb.lookup("a"); ok {
+		fmt.Println("saved write is still pending")
+		t.Fail()
+	}
+}
+
+// A Store failing saves of a key
+type failingStore struct {
+	memStore
+	bad interface{}
+	attempts int32
+}
+
+func (s *failingStore) Save(key interface{}, val interface{}, serial int64) error {
+	if key == s.bad {
+		atomic.AddInt32(&s.attempts, 1)
+		return errors.New("save failed")
+	}
+	return s.memStore.Save(key, val, serial)
+}
+
+func TestWriteBehindRetries(t *testing.T) {
+	cache := &Cache{
+		options: &CacheOptions{
+			Marshal: defaultMarshal,
+			Unmarshal: defaultUnmarshal,
+		},
+	}
+	store := &failingStore{
+		memStore: memStore{vals: make(map[interface{}]interface{})},
+		bad: "bad",
+	}
+	var failed int32
+	wb := NewWriteBehind(cache, store, &WriteBehindOptions{
+		Interval: time.Hour,
+		BatchSize: 1,
+		Retries: 2,
+		RetryBackoff: 20 * time.Millisecond,
+		OnError: func(key interface{}, err error) {
+			atomic.AddInt32(&failed, 1)
+		},
+	})
+
+	wb.enqueue(pendingSet("bad", "b1", 1))
+	time.Sleep(5 * time.Millisecond)
+	wb.enqueue(pendingSet("good", "g1", 1))
+	time.Sleep(5 * time.Millisecond)
+
+	store.mx.Lock()
+	if store.vals["good"] != "g1" {
+		fmt.Println("write is delayed by a retrying one:", store.vals)
+		t.Fail()
+	}
+	store.mx.Unlock()
+
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&store.attempts); n != 3 {
+		fmt.Println("incorrect attempts of a failing write", n)
+		t.Fail()
+	}
+	if n := atomic.LoadInt32(&failed); n != 1 {
+		fmt.Println("incorrect OnError calls", n)
+		t.Fail()
+	}
+	if pw, ok := wb.lookup("bad"); ok {
+		fmt.Println("write given up stays pending:", pw)
+		t.Fail()
+	}
+
+	wb.Shutdown()
+	if _, err := wb.Set("good", "g2"); err != ErrShutdown {
+		fmt.Println("unexpected error for Set after shutdown:", err)
+		t.Fail()
+	}
+	if err := wb.Del("good"); err != ErrShutdown {
+		fmt.Println("unexpected error for Del after shutdown:", err)
+		t.Fail()
+	}
+}
+
+func TestScan(t *testing.T) {
+	connector, err := connector.NewSingle(":6379", 2)
+	if err != nil {
+		t.Fatal("can't create connector")
+	}
+	cache, err := NewCache(connector, nil)
+	if err != nil {
+		t.Fatal("can't create cache")
+	}
+	scans := cache.Namespace("scanTest")
+
+	keys := make(map[string]int64)
+	for i := 0; i < 250; i++ {
+		key := fmt.Sprintf("scanKey:%d", i)
+		serial, err := scans.Set([]byte(key), i)
+		if err != nil {
+			t.Fatal("Set failed", err)
+		}
+		keys[key] = serial
+	}
+	scans.Set([]byte("otherKey"), 0)
+
+	found := make(map[string]int64)
+	var cursor string
+	s := scans.Scan("scanKey:*")
+	for s.Next() {
+		var key []byte
+		if err := s.Key(&key); err != nil {
+			t.Fatal("Key failed", err)
+		}
+		found[string(key)] = s.Serial()
+		if len(found) == 100 {
+			cursor = s.Cursor()
+			break
+		}
+	}
+	if s.Err() != nil {
+		t.Fatal("Scan failed", s.Err())
+	}
+
+	if s, err = scans.ScanFrom("scanKey:*", cursor); err != nil {
+		t.Fatal("ScanFrom failed", err)
+	}
+	for s.Next() {
+		var key []byte
+		if err := s.Key(&key); err != nil {
+			t.Fatal("Key failed", err)
+		}
+		found[string(key)] = s.Serial()
+	}
+	if s.Err() != nil {
+		t.Fatal("resumed Scan failed", s.Err())
+	}
+
+	if len(found) != len(keys) {
+		fmt.Println("unexpected number of keys:", len(found), len(keys))
+		t.Fail()
+	}
+	for key, serial := range keys {
+		if found[key] != serial {
+			fmt.Println("assert failed for", key, ". Got:{", found[key], "}, Expected:{", serial, "}")
+			t.Fail()
+		}
+	}
+
+	if _, err := cache.ScanFrom("*", "0:6379"); err != ErrInvalidCursor {
+		fmt.Println("invalid cursor is accepted:", err)
+		t.Fail()
+	}
+
+	if err := scans.Flush(); err != nil {
+		t.Fatal("Flush failed", err)
+	}
+	for s := scans.Scan("scanKey:*"); s.Next(); {
+		fmt.Println("flushed key is scanned:", string(s.cur.bkey))
+		t.Fail()
+		break
+	}
+
+	dels := []interface{}{[]byte("otherKey")}
+	for key := range keys {
+		dels = append(dels, []byte(key))
+	}
+	scans.MDel(dels)
+}
+
+func TestGlobEscape(t *testing.T) {
+	if escaped := globEscape("a*b?c[d]e\\f"); escaped != "a\\*b\\?c\\[d\\]e\\\\f" {
+		fmt.Println("unexpected escape:", escaped)
+		t.Fail()
+	}
+	if escaped := globEscape("plain:"); escaped != "plain:" {
+		fmt.Println("unexpected escape:", escaped)
+		t.Fail()
+	}
+}
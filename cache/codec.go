@@ -0,0 +1,265 @@
+package cache
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"time"
+)
+
+var (
+	ErrDecompress = errors.New("Failed to decompress a value")
+)
+
+// Stored values may have a 2-byte header to describe how they are encoded.
+// The header begins with a zero byte, which neither JSON texts nor usual strings begin with.
+// A marshaled value beginning with a zero byte would be escaped with the raw header,
+// so any marshaled value could be stored safely.
+const (
+	headerMark = 0x00
+
+	// Raw value which begins with a zero byte
+	headerRaw = 'R'
+
+	// Value compressed with deflate
+	headerCompressed = 'Z'
+
+	// Value encrypted with a key of the Keyring
+	headerEncrypted = 'E'
+
+	// Tombstone for an absent entity, which has no payload
+	headerNegative = 'N'
+
+	// Value with its recompute cost in micros, as an uvarint following the header.
+	// It wraps any other encodings, so the cost could be read without decoding.
+	headerCost = 'C'
+
+	// Value with the local wall clock in micros when it is written, as an uint64 big-endian following the header.
+	// It is recorded for serials given by callers, which could not be compared with validity serials.
+	// It wraps any other encodings including the cost, except for tags.
+	headerWritten = 'W'
+
+	// Value with tags and their generations, which scripts prepend on Set.
+	// A length of the JSON list in uint32 big-endian and the list follow the header.
+	// It wraps any other encodings including the cost.
+	headerTagged = 'T'
+)
+
+// Returns the kind of the header, or zero if no header.
+func headerOf(data []byte) byte {
+	if len(data) >= 2 && data[0] == headerMark {
+		return data[1]
+	}
+	return 0
+}
+
+// Prepend a header of the kind to the payload.
+func withHeader(kind byte, payload []byte) []byte {
+	data := make([]byte, 0, len(payload) + 2)
+	data = append(data, headerMark, kind)
+	return append(data, payload...)
+}
+
+// Marshal and encode a value to store.
+func (c *Cache) marshalValue(bkey []byte, val interface{}) ([]byte, error) {
+	bval, err := c.options.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	return c.encode(bkey, bval)
+}
+
+// Decode and unmarshal a stored value.
+func (c *Cache) unmarshalValue(bkey []byte, data []byte, val interface{}) error {
+	bval, err := c.decode(bkey, data)
+	if err != nil {
+		return err
+	}
+	return c.options.Unmarshal(bval, val)
+}
+
+// Encode a marshaled value to store.
+// It would be compressed if larger than the threshold and the compression is effective.
+// Then it would be encrypted if the Keyring is set.
+func (c *Cache) encode(bkey []byte, bval []byte) ([]byte, error) {
+	data := bval
+	if len(bval) > 0 && bval[0] == headerMark {
+		data = withHeader(headerRaw, bval)
+	}
+	if c.options.CompressThreshold > 0 && len(bval) > c.options.CompressThreshold {
+		if compressed, err := compress(bval, c.options.CompressLevel); err != nil {
+			return nil, err
+		} else if len(compressed) < len(data) {
+			data = compressed
+		}
+	}
+	if c.options.Keyring != nil {
+		return c.options.Keyring.seal(bkey, data)
+	}
+	return data, nil
+}
+
+// Encode a marshaled value with options of a Set-like call.
+// With a serial given by the caller, the time of writing is recorded as well.
+func (c *Cache) encodeWith(bkey []byte, bval []byte, opts []SetOption) ([]byte, error) {
+	data, err := c.encode(bkey, bval)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = c.encodeCost(data, opts); err != nil {
+		return nil, err
+	}
+	if c.setOptions(opts).serial > 0 {
+		header := make([]byte, 10, 10 + len(data))
+		header[0], header[1] = headerMark, headerWritten
+		binary.BigEndian.PutUint64(header[2:], uint64(getSerial()))
+		data = append(header, data...)
+	}
+	return data, nil
+}
+
+// Prepend the recompute cost in options, if any, to the encoded value.
+func (c *Cache) encodeCost(data []byte, opts []SetOption) ([]byte, error) {
+	if cost := c.setOptions(opts).cost; cost > 0 {
+		header := make([]byte, 2 + binary.MaxVarintLen64)
+		header[0], header[1] = headerMark, headerCost
+		n := binary.PutUvarint(header[2:], uint64(cost / time.Microsecond))
+		data = append(header[:2 + n], data...)
+	}
+	return data, nil
+}
+
+// Returns a tombstone with options of a Set-like call.
+func (c *Cache) tombstone(opts []SetOption) []byte {
+	data, _ := c.encodeCost([]byte{headerMark, headerNegative}, opts)
+	return data
+}
+
+// Returns the recorded recompute cost of a stored value, or zero if none.
+func costOf(data []byte) time.Duration {
+	_, data = splitWritten(stripTags(data))
+	cost, _ := splitCost(data)
+	return cost
+}
+
+// Returns tags recorded with a stored value, or nil if none.
+func tagsOf(data []byte) []string {
+	if headerOf(data) != headerTagged || len(data) < 6 {
+		return nil
+	}
+	n := binary.BigEndian.Uint32(data[2:6])
+	if uint64(len(data)) < 6 + uint64(n) {
+		return nil
+	}
+	var hdr []json.RawMessage
+	if err := json.Unmarshal(data[6:6 + n], &hdr); err != nil || len(hdr) == 0 {
+		return nil
+	}
+	var tags []string
+	if err := json.Unmarshal(hdr[0], &tags); err != nil {
+		return nil
+	}
+	return tags
+}
+
+// Strip tags from a stored value.
+func stripTags(data []byte) []byte {
+	if headerOf(data) != headerTagged || len(data) < 6 {
+		return data
+	}
+	n := binary.BigEndian.Uint32(data[2:6])
+	if uint64(len(data)) < 6 + uint64(n) {
+		return data
+	}
+	return data[6 + n:]
+}
+
+// Returns the time when a stored value is written, the recorded one or the serial.
+func writtenOf(data []byte, serial int64) int64 {
+	if written, _ := splitWritten(stripTags(data)); written > 0 {
+		return written
+	}
+	return serial
+}
+
+// Split the recorded time of writing from a stored value, zero if none.
+func splitWritten(data []byte) (int64, []byte) {
+	if headerOf(data) != headerWritten || len(data) < 10 {
+		return 0, data
+	}
+	return int64(binary.BigEndian.Uint64(data[2:10])), data[10:]
+}
+
+// Split the recompute cost from a stored value.
+func splitCost(data []byte) (time.Duration, []byte) {
+	if headerOf(data) != headerCost {
+		return 0, data
+	}
+	cost, n := binary.Uvarint(data[2:])
+	if n <= 0 {
+		return 0, data
+	}
+	return time.Duration(cost) * time.Microsecond, data[2 + n:]
+}
+
+// Decode a stored value into the marshaled form.
+// Values without known headers are regarded as marshaled ones as is.
+func (c *Cache) decode(bkey []byte, data []byte) ([]byte, error) {
+	_, data = splitWritten(stripTags(data))
+	_, data = splitCost(data)
+	if headerOf(data) == headerNegative {
+		return nil, ErrNegative
+	}
+	if c.options.Keyring != nil {
+		payload, err := c.options.Keyring.open(bkey, data)
+		if err != nil {
+			return nil, err
+		}
+		data = payload
+	} else if headerOf(data) == headerEncrypted {
+		return nil, ErrDecrypt
+	}
+
+	switch headerOf(data) {
+	case headerRaw:
+		return data[2:], nil
+	case headerCompressed:
+		return decompress(data)
+	default:
+		return data, nil
+	}
+}
+
+// Compress the value with deflate, prepending the header.
+func compress(bval []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	var buf bytes.Buffer
+	buf.Write([]byte{headerMark, headerCompressed})
+	w, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(bval); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress the value with the header.
+func decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data[2:]))
+	defer r.Close()
+	bval, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, ErrDecompress
+	}
+	return bval, nil
+}
@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrDecrypt = errors.New("Failed to decrypt a value")
+	ErrUnknownKeyID = errors.New("Unknown encryption key ID")
+)
+
+// Keyring holds AES keys to encrypt stored values with AES-GCM.
+// Each encrypted value carries the ID of its key,
+// so values encrypted with older keys could be decrypted after a rotation.
+// It is safe for concurrent uses.
+type Keyring struct {
+	mx sync.RWMutex
+	aeads map[uint32]cipher.AEAD
+	current uint32
+	ready bool
+}
+
+// NewKeyring returns an empty Keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{
+		aeads: make(map[uint32]cipher.AEAD),
+	}
+}
+
+// Add registers an AES key of 16, 24 or 32 bytes with the ID.
+// The first key added would be used to encrypt values until Use is called.
+func (k *Keyring) Add(id uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	k.aeads[id] = aead
+	if !k.ready {
+		k.current = id
+		k.ready = true
+	}
+	return nil
+}
+
+// Use makes the key with the ID encrypt new values.
+// Rotate keys by adding a new key and using it, keeping the old keys until their values expire.
+func (k *Keyring) Use(id uint32) error {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	if _, ok := k.aeads[id]; !ok {
+		return ErrUnknownKeyID
+	}
+	k.current = id
+	k.ready = true
+	return nil
+}
+
+// Remove drops the key with the ID.
+// Values encrypted with it could not be decrypted any more.
+func (k *Keyring) Remove(id uint32) {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	delete(k.aeads, id)
+	if k.current == id {
+		k.ready = false
+	}
+}
+
+// Encrypt the payload with the current key.
+// The cache key is authenticated as well, so a value could not be moved to another key.
+// The result has the header, the key ID, the nonce and the sealed payload in order.
+func (k *Keyring) seal(bkey []byte, payload []byte) ([]byte, error) {
+	k.mx.RLock()
+	id, aead, ready := k.current, k.aeads[k.current], k.ready
+	k.mx.RUnlock()
+	if !ready {
+		return nil, ErrUnknownKeyID
+	}
+
+	data := make([]byte, 6 + aead.NonceSize(), 6 + aead.NonceSize() + len(payload) + aead.Overhead())
+	data[0], data[1] = headerMark, headerEncrypted
+	binary.BigEndian.PutUint32(data[2:6], id)
+	nonce := data[6:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(data, nonce, payload, bkey), nil
+}
+
+// Decrypt the encrypted value with the key of its ID.
+func (k *Keyring) open(bkey []byte, data []byte) ([]byte, error) {
+	if headerOf(data) != headerEncrypted || len(data) < 6 {
+		return nil, ErrDecrypt
+	}
+	id := binary.BigEndian.Uint32(data[2:6])
+
+	k.mx.RLock()
+	aead, ok := k.aeads[id]
+	k.mx.RUnlock()
+	if !ok {
+		return nil, ErrUnknownKeyID
+	}
+
+	if len(data) < 6 + aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, sealed := data[6:6 + aead.NonceSize()], data[6 + aead.NonceSize():]
+	payload, err := aead.Open(nil, nonce, sealed, bkey)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return payload, nil
+}
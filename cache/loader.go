@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLoaderPanic = errors.New("Loader panicked")
+)
+
+// Loader returns a value for the key on cache misses,
+// typically by reading it from the source of truth.
+type Loader func(key interface{}) (interface{}, error)
+
+// A load in flight for a key.
+// Its results are shared by every caller waiting for the same key.
+type call struct {
+	done chan struct{}
+	bval []byte
+	serial int64
+	err error
+}
+
+// A group of loads coalesced by keys, in the manner of the singleflight.
+type flight struct {
+	mx sync.Mutex
+	calls map[string]*call
+}
+
+// Run fn once for the key at a time.
+// Callers coming while fn is in flight would wait and share its results,
+// unless their contexts are done.
+func (f *flight) do(ctx context.Context, key string, fn func() ([]byte, int64, error)) ([]byte, int64, error) {
+	f.mx.Lock()
+	if f.calls == nil {
+		f.calls = make(map[string]*call)
+	}
+	if cl, ok := f.calls[key]; ok {
+		f.mx.Unlock()
+		select {
+		case <-cl.done:
+			return cl.bval, cl.serial, cl.err
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+	cl := f.register(key)
+	f.mx.Unlock()
+
+	return f.run(key, cl, fn)
+}
+
+// Start fn for the key in background, unless a call for the key is in flight.
+// Callers of do for the key would wait and share its results as well.
+// It returns whether fn is started.
+func (f *flight) start(key string, fn func() ([]byte, int64, error)) bool {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.calls == nil {
+		f.calls = make(map[string]*call)
+	}
+	if _, ok := f.calls[key]; ok {
+		return false
+	}
+	cl := f.register(key)
+	go f.run(key, cl, fn)
+	return true
+}
+
+// Register a new call for the key. The mutex should be held.
+func (f *flight) register(key string) *call {
+	cl := &call{
+		done: make(chan struct{}),
+	}
+	f.calls[key] = cl
+	return cl
+}
+
+// Run fn for the registered call, and unregister it when done.
+// A panic in fn is recovered as an error wrapping ErrLoaderPanic, shared by the waiting callers,
+// so a background refresh would not crash the process.
+func (f *flight) run(key string, cl *call, fn func() ([]byte, int64, error)) (bval []byte, serial int64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			cl.bval, cl.serial, cl.err = nil, 0, fmt.Errorf("%w: %v", ErrLoaderPanic, r)
+			bval, serial, err = cl.bval, cl.serial, cl.err
+		}
+		f.mx.Lock()
+		delete(f.calls, key)
+		f.mx.Unlock()
+		close(cl.done)
+	}()
+
+	cl.bval, cl.serial, cl.err = fn()
+	return cl.bval, cl.serial, cl.err
+}
+
+// GetOrLoad returns a cached value like Get.
+// On misses, including stale or invalidated ones, it calls the loader and stores the loaded value via Set.
+// If the loader returns ErrNotFound, or an error wrapping it, and NegativeExpiration of CacheOptions is set,
+// a tombstone is stored instead and GetOrLoad returns ErrNegative, without calling the loader again until it expires.
+// Concurrent calls for the same key in the process would share a single loader call,
+// so a hot key would not cause a thundering herd against the source of truth.
+// If a newer value is stored while loading, GetOrLoad returns the newer one.
+// If the loader is nil, the Loader of CacheOptions would be used.
+// If the loader panics, GetOrLoad returns an error wrapping ErrLoaderPanic.
+// The options apply to the loaded value like Set, and to a tombstone except for its expiration time.
+// Options of the call which starts the loading are taken, when calls are coalesced.
+// Soft-expired values, or ones chosen by the early recomputation,
+// would be refreshed in background with the loader, carrying their tags to the refreshed ones.
+func (c *Cache) GetOrLoad(key interface{}, val interface{}, loader Loader, opts ...SetOption) (int64, error) {
+	return c.GetOrLoadContext(context.Background(), key, val, loader, opts...)
+}
+
+// GetOrLoadContext is same with GetOrLoad within the context.
+// The loading call runs with the context of the caller which starts it,
+// and others waiting for it would give up when their own contexts are done.
+func (c *Cache) GetOrLoadContext(ctx context.Context, key interface{}, val interface{}, loader Loader, opts ...SetOption) (int64, error) {
+	if loader == nil {
+		loader = c.options.Loader
+	}
+	it, err := c.get(ctx, key, val, 0, loader)
+	if !errors.Is(err, ErrNoKey) || loader == nil {
+		return it.serial, err
+	}
+
+	bkey, err := c.marshalKey(key)
+	if err != nil {
+		return 0, err
+	}
+	bval, serial, err := c.flight.do(ctx, string(bkey), func() ([]byte, int64, error) {
+		return c.load(key, bkey, loader, opts, func(data []byte, opts []SetOption) (int64, error) {
+			return c.setData(ctx, bkey, data, opts)
+		})
+	})
+	if err == ErrNegative {
+		return serial, err
+	}
+	if err == ErrSetFailed {
+		return c.GetContext(ctx, key, val)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.options.Unmarshal(bval, val); err != nil {
+		return 0, err
+	}
+	return serial, nil
+}
+
+// Decide whether a value written at the time is soft-expired, by its age now.
+// It is always false unless SoftExpiration of CacheOptions is set.
+func (c *Cache) isStale(written int64) bool {
+	if c.options.SoftExpiration <= 0 {
+		return false
+	}
+	return getSerial() - written > int64(c.options.SoftExpiration / time.Microsecond)
+}
+
+// Decide whether to recompute a value before its expiration, in the manner of XFetch.
+// Each process decides independently with the recorded recompute cost and the remaining time to live,
+// so the recomputation happens earlier with a higher probability as the expiration approaches.
+func (c *Cache) recomputeEarly(it item) bool {
+	if c.options.EarlyRecompute <= 0 || it.cost <= 0 || it.ttl < 0 {
+		return false
+	}
+	gap := -float64(it.cost) * c.options.EarlyRecompute * math.Log(1 - rand.Float64())
+	return gap >= float64(it.ttl)
+}
+
+// Refresh a value in background with the loader, if it is soft-expired or to be recomputed early.
+// At most one refresh for a key would be in flight in the process.
+// The refreshed value is stored via CheckAndSet with the serial of the current one,
+// so a newer value stored in the meantime would not be overwritten.
+// Tags of the current one are carried to the refreshed one, so it would be invalidated with them.
+func (c *Cache) revalidate(key interface{}, bkey []byte, it item, loader Loader) {
+	if loader == nil || (!it.stale && !c.recomputeEarly(it)) {
+		return
+	}
+	opts := []SetOption{WithTags(tagsOf(it.data)...)}
+	c.flight.start(string(bkey), func() ([]byte, int64, error) {
+		return c.load(key, bkey, loader, opts, func(data []byte, opts []SetOption) (int64, error) {
+			return c.checkAndSetData(context.Background(), bkey, data, it.serial, opts)
+		})
+	})
+}
+
+// Call the loader and store its result with the options and the given store function, recording the cost.
+// If the loader reports ErrNotFound, or an error wrapping it, and NegativeExpiration is set, a tombstone would be stored instead,
+// and it returns ErrNegative with the serial of the tombstone.
+func (c *Cache) load(key interface{}, bkey []byte, loader Loader, opts []SetOption, store func([]byte, []SetOption) (int64, error)) ([]byte, int64, error) {
+	start := time.Now()
+	loaded, err := loader(key)
+	opts = append(opts[:len(opts):len(opts)], withCost(time.Since(start)))
+	if errors.Is(err, ErrNotFound) && c.options.NegativeExpiration > 0 {
+		opts = append(opts, WithTTL(c.options.NegativeExpiration))
+		serial, err := store(c.tombstone(opts), opts)
+		if err != nil {
+			return nil, 0, err
+		}
+		return nil, serial, ErrNegative
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	bval, err := c.options.Marshal(loaded)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := c.encodeWith(bkey, bval, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	serial, err := store(data, opts)
+	return bval, serial, err
+}
@@ -0,0 +1,396 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	. "github.com/beatuslapis/gorelib.v0/connector"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+var (
+	ErrMismatch = errors.New("Numbers of keys and values mismatch")
+	ErrNoBroadcast = errors.New("Connector could not connect to all the redis instances")
+)
+
+// MultiError holds an error for each key of a multi-key operation.
+// A nil entry means the operation for the key succeeded.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	n := 0
+	var first error
+	for _, err := range m {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			n++
+		}
+	}
+	switch n {
+	case 0:
+		return "no error"
+	case 1:
+		return first.Error()
+	default:
+		return fmt.Sprintf("%s (and %d other errors)", first, n - 1)
+	}
+}
+
+// Returns the MultiError if it has any error, or nil.
+func (m MultiError) orNil() error {
+	for _, err := range m {
+		if err != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+// Lua script for getting multiple cached values.
+// It returns an array of the get function results in the order of the keys.
+const luaForMGet = luaGetFunc +
+	"local res={} " +
+	"for i, key in ipairs(KEYS) do " +
+	"  res[i]=get(key, ARGV[1], 0) " +
+	"end " +
+	"return res "
+
+// Lua script for setting multiple cache values with the same serial.
+// Pairs of a value and its expiration time follow the serial, the expiration mode, the retention parameters, and tags in ARGV.
+// It returns an array of the set function results in the order of the keys.
+const luaForMSet = luaSetFunc +
+	"local res={} " +
+	"for i, key in ipairs(KEYS) do " +
+	"  res[i]=set(key, ARGV[2*i+4], ARGV[1], ARGV[2], ARGV[2*i+5], ARGV[3], ARGV[4], ARGV[5]) " +
+	"end " +
+	"return res "
+
+// Connect to redis instances for the keys.
+// If the connector is not a BatchConnector, each key would have its own Conn.
+func (c *Cache) connectBatch(ctx context.Context, bkeys [][]byte) []Conn {
+	if len(bkeys) == 0 {
+		return nil
+	}
+	if bc, ok := c.connector.(BatchConnector); ok {
+		if err := ctx.Err(); err != nil {
+			return []Conn{{Keys: allIndices(len(bkeys)), Err: err}}
+		}
+		return bc.ConnectBatch(ctx, bkeys)
+	}
+
+	conns := make([]Conn, len(bkeys))
+	for i, bkey := range bkeys {
+		conns[i].Keys = []int{i}
+		conns[i].Client, conns[i].Disconnect, conns[i].ValidSince, conns[i].Err = c.connect(ctx, bkey)
+	}
+	return conns
+}
+
+func allIndices(n int) []int {
+	indices := make([]int, n)
+	for i := range indices {
+		indices[i] = i
+	}
+	return indices
+}
+
+// Run fn for each connected batch concurrently, and dispose connections.
+// Keys of failed connections would have the connection error.
+func eachConn(conns []Conn, errs MultiError, fn func(conn *Conn)) {
+	var wg sync.WaitGroup
+	for i := range conns {
+		conn := &conns[i]
+		if conn.Err != nil {
+			for _, idx := range conn.Keys {
+				errs[idx] = conn.Err
+			}
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func(){ if conn.Disconnect != nil { conn.Disconnect() } }()
+			fn(conn)
+		}()
+	}
+	wg.Wait()
+}
+
+// Run fn for every redis instance of the connector concurrently, and dispose connections.
+// It returns a MultiError holding an error for each instance if any fails.
+func (c *Cache) broadcast(ctx context.Context, fn func(conn *Conn) error) error {
+	bc, ok := c.connector.(BroadcastConnector)
+	if !ok {
+		return ErrNoBroadcast
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	conns := bc.ConnectAll(ctx)
+	errs := make(MultiError, len(conns))
+	for i := range conns {
+		conns[i].Keys = []int{i}
+	}
+	eachConn(conns, errs, func(conn *Conn) {
+		errs[conn.Keys[0]] = fn(conn)
+	})
+	return errs.orNil()
+}
+
+// Generate a serial shared by all the connections, with the first connected one.
+func (c *Cache) serialOf(ctx context.Context, conns []Conn) (int64, error) {
+	for i := range conns {
+		if conns[i].Err == nil {
+			return c.serial(ctx, conns[i].Client, nil)
+		}
+	}
+	return getSerial(), nil
+}
+
+// Dispose all the connected connections.
+func disconnectAll(conns []Conn) {
+	for i := range conns {
+		if conns[i].Err == nil && conns[i].Disconnect != nil {
+			conns[i].Disconnect()
+		}
+	}
+}
+
+// Marshal all the given keys.
+func (c *Cache) marshalAll(keys []interface{}) ([][]byte, error) {
+	bkeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		bkey, err := c.marshalKey(key)
+		if err != nil {
+			return nil, err
+		}
+		bkeys[i] = bkey
+	}
+	return bkeys, nil
+}
+
+// MGet returns multiple cached values at once.
+// Keys are grouped by the redis instances they are located on,
+// and each group is fetched by a single script call.
+// It fills vals, which should be pointers like Get, and returns serials in the order of keys.
+// Soft-expired values would be refreshed in background like Get.
+// If any key fails, including misses, it returns a MultiError holding an error for each key.
+func (c *Cache) MGet(keys []interface{}, vals []interface{}) ([]int64, error) {
+	return c.MGetContext(context.Background(), keys, vals)
+}
+
+// MGetContext is same with MGet within the context.
+func (c *Cache) MGetContext(ctx context.Context, keys []interface{}, vals []interface{}) ([]int64, error) {
+	if len(keys) != len(vals) {
+		return nil, ErrMismatch
+	}
+	bkeys, err := c.marshalAll(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	serials := make([]int64, len(keys))
+	errs := make(MultiError, len(keys))
+	eachConn(c.connectBatch(ctx, bkeys), errs, func(conn *Conn) {
+		args := make([]interface{}, 0, len(conn.Keys) + 1)
+		for _, idx := range conn.Keys {
+			args = append(args, bkeys[idx])
+		}
+		args = append(args, conn.ValidSince)
+
+		res, err := luaEval(ctx, conn.Client, luaForMGet, len(conn.Keys), args...).Array()
+		if err == nil && len(res) != len(conn.Keys) {
+			err = ErrRESPParse
+		}
+		for i, idx := range conn.Keys {
+			if err != nil {
+				errs[idx] = err
+			} else {
+				it, err := c.unmarshalGet(bkeys[idx], res[i], conn.ValidSince, vals[idx])
+				if err == nil || err == ErrNegative {
+					c.revalidate(keys[idx], bkeys[idx], it, c.options.Loader)
+				}
+				serials[idx], errs[idx] = it.serial, err
+			}
+		}
+	})
+	return serials, errs.orNil()
+}
+
+// MSet puts multiple values with keys at once, with the same serial.
+// Keys are grouped like MGet, and each group is stored by a single script call.
+// The serial is generated with the first connected redis instance, for the SerialSource.
+// The jitter of the expiration time is drawn for each value, so they would not expire at once.
+// It returns serials in the order of keys, which would be zero for failed keys.
+// If any key fails, including ErrSetFailed, it returns a MultiError holding an error for each key.
+// If keys are replicated, each key is stored on its replicas like Set, rather than grouped.
+func (c *Cache) MSet(keys []interface{}, vals []interface{}, opts ...SetOption) ([]int64, error) {
+	return c.MSetContext(context.Background(), keys, vals, opts...)
+}
+
+// MSetContext is same with MSet within the context.
+func (c *Cache) MSetContext(ctx context.Context, keys []interface{}, vals []interface{}, opts ...SetOption) ([]int64, error) {
+	if len(keys) != len(vals) {
+		return nil, ErrMismatch
+	}
+	bkeys, err := c.marshalAll(keys)
+	if err != nil {
+		return nil, err
+	}
+	bvals := make([][]byte, len(vals))
+	for i, val := range vals {
+		if bvals[i], err = c.marshalValue(bkeys[i], val); err != nil {
+			return nil, err
+		}
+	}
+	var mode string
+	mss := make([]int64, len(keys))
+	for i := range mss {
+		if mode, mss[i], err = c.expiration(opts); err != nil {
+			return nil, err
+		}
+	}
+	var serials []int64
+	if c.replicated() {
+		serials, err = c.msetReplicas(ctx, bkeys, bvals, mode, mss, opts)
+	} else {
+		serials, err = c.msetBatch(ctx, bkeys, bvals, mode, mss, opts)
+	}
+	var written [][]byte
+	var wserials []int64
+	for i, serial := range serials {
+		if serial != 0 {
+			written, wserials = append(written, bkeys[i]), append(wserials, serial)
+		}
+	}
+	c.notify(ctx, written, wserials)
+	return serials, err
+}
+
+// Set multiple values with the same serial, grouped by the redis instances.
+func (c *Cache) msetBatch(ctx context.Context, bkeys [][]byte, bvals [][]byte, mode string, mss []int64, opts []SetOption) ([]int64, error) {
+	conns := c.connectBatch(WithWrite(ctx), bkeys)
+	serial, err := c.serialOf(ctx, conns)
+	if err != nil {
+		disconnectAll(conns)
+		return nil, err
+	}
+	depth, floor := c.retention(serial)
+	tags := c.tags(opts)
+	serials := make([]int64, len(bkeys))
+	errs := make(MultiError, len(bkeys))
+	eachConn(conns, errs, func(conn *Conn) {
+		args := make([]interface{}, 0, 3 * len(conn.Keys) + 5)
+		for _, idx := range conn.Keys {
+			args = append(args, bkeys[idx])
+		}
+		args = append(args, serial, mode, depth, floor, tags)
+		for _, idx := range conn.Keys {
+			args = append(args, bvals[idx], mss[idx])
+		}
+
+		res, err := luaEval(ctx, conn.Client, luaForMSet, len(conn.Keys), args...).Array()
+		if err == nil && len(res) != len(conn.Keys) {
+			err = ErrRESPParse
+		}
+		for i, idx := range conn.Keys {
+			switch {
+			case err != nil:
+				errs[idx] = err
+			case res[i].IsType(redis.Nil):
+				errs[idx] = ErrSetFailed
+			default:
+				serials[idx] = serial
+				atomic.AddInt64(&c.loads, 1)
+			}
+		}
+	})
+	return serials, errs.orNil()
+}
+
+// Set multiple values with the same serial, on the replicas of each key like Set.
+func (c *Cache) msetReplicas(ctx context.Context, bkeys [][]byte, bvals [][]byte, mode string, mss []int64, opts []SetOption) ([]int64, error) {
+	replicas := c.connectEachReplicas(WithWrite(ctx), bkeys)
+	var all []Conn
+	for i := range replicas {
+		all = append(all, replicas[i]...)
+	}
+	serial, err := c.serialOf(ctx, all)
+	if err != nil {
+		disconnectAll(all)
+		return nil, err
+	}
+	depth, floor := c.retention(serial)
+	tags := c.tags(opts)
+	serials := make([]int64, len(bkeys))
+	errs := make(MultiError, len(bkeys))
+	eachKeyReplicas(replicas, errs, func(i int, conns []Conn, primary *Conn) error {
+		err := replicate(conns, primary, func(conn *Conn) error {
+			resp := luaEval(ctx, conn.Client, luaForSet, 1, bkeys[i], bvals[i], serial, mode, mss[i], depth, floor, tags)
+			if resp.Err != nil {
+				return resp.Err
+			}
+			if resp.IsType(redis.Nil) {
+				return ErrSetFailed
+			}
+			return nil
+		}, nil)
+		if err == nil {
+			serials[i] = serial
+			atomic.AddInt64(&c.loads, 1)
+		}
+		return err
+	})
+	return serials, errs.orNil()
+}
+
+// MDel removes cached values for multiple keys at once.
+// Keys are grouped like MGet, and each group is removed by a single DEL command.
+// If keys are replicated, each key is removed from all of its replicas like Del, rather than grouped.
+// If any group fails, it returns a MultiError holding an error for each key.
+func (c *Cache) MDel(keys []interface{}) error {
+	return c.MDelContext(context.Background(), keys)
+}
+
+// MDelContext is same with MDel within the context.
+func (c *Cache) MDelContext(ctx context.Context, keys []interface{}) error {
+	bkeys, err := c.marshalAll(keys)
+	if err != nil {
+		return err
+	}
+
+	errs := make(MultiError, len(keys))
+	if c.replicated() {
+		eachKeyReplicas(c.connectEachReplicas(WithWrite(ctx), bkeys), errs, func(i int, conns []Conn, primary *Conn) error {
+			return delReplicas(ctx, conns, bkeys[i])
+		})
+	} else {
+		eachConn(c.connectBatch(WithWrite(ctx), bkeys), errs, func(conn *Conn) {
+			args := make([]interface{}, len(conn.Keys))
+			for i, idx := range conn.Keys {
+				args[i] = bkeys[idx]
+			}
+			resp := Roundtrip(ctx, conn.Client, func() *redis.Resp { return conn.Client.Cmd("DEL", args...) })
+			if resp.Err != nil {
+				for _, idx := range conn.Keys {
+					errs[idx] = resp.Err
+				}
+			}
+		})
+	}
+
+	var removed [][]byte
+	for i, err := range errs {
+		if err == nil {
+			removed = append(removed, bkeys[i])
+		}
+	}
+	c.notify(ctx, removed, make([]int64, len(removed)))
+	return errs.orNil()
+}
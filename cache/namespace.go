@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"context"
+)
+
+// Prefix of the implicit tags of namespaces.
+const namespaceTagPrefix = "namespace:"
+
+// Namespace returns a view of the Cache whose keys are prefixed with the name and a colon.
+// Values set through the view carry an implicit tag of the namespace,
+// so Flush would invalidate all of them at once on every redis instance.
+// Namespaces could be nested, then the prefixes and tags are accumulated.
+// The view shares the connector, options, loads in flight and near caches, but has its own counters.
+func (c *Cache) Namespace(name string) *Cache {
+	prefix := make([]byte, 0, len(c.prefix) + len(name) + 1)
+	prefix = append(prefix, c.prefix...)
+	prefix = append(prefix, name...)
+	prefix = append(prefix, ':')
+
+	nstags := make([]string, 0, len(c.nstags) + 1)
+	nstags = append(nstags, c.nstags...)
+	nstags = append(nstags, namespaceTagPrefix + string(prefix[:len(prefix) - 1]))
+
+	return &Cache{
+		connector: c.connector,
+		options: c.options,
+		flight: c.flight,
+		near: c.near,
+		prefix: prefix,
+		nstags: nstags,
+	}
+}
+
+// Flush logically removes every value in the namespace, bumping the generation of its tag.
+// It neither scans nor removes keys, which would expire in time.
+// Values of other namespaces, or ones out of any namespace, are not affected.
+// For a Cache not a namespace view, Flush does nothing.
+func (c *Cache) Flush() error {
+	return c.FlushContext(context.Background())
+}
+
+// FlushContext is same with Flush within the context.
+func (c *Cache) FlushContext(ctx context.Context) error {
+	if len(c.nstags) == 0 {
+		return nil
+	}
+	return c.InvalidateTagContext(ctx, c.nstags[len(c.nstags) - 1])
+}
+
+// Marshal a key, prepending the prefix of the namespace if any.
+func (c *Cache) marshalKey(key interface{}) ([]byte, error) {
+	bkey, err := c.options.Marshal(key)
+	if err != nil || len(c.prefix) == 0 {
+		return bkey, err
+	}
+	return append(append(make([]byte, 0, len(c.prefix) + len(bkey)), c.prefix...), bkey...), nil
+}
@@ -0,0 +1,541 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/beatuslapis/gorelib.v0/connector"
+
+	"github.com/mediocregopher/radix.v2/pubsub"
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// An option structure to create a near cache
+type NearOptions struct {
+	// Maximum number of entries in the near cache, 10000 if not set.
+	// The least recently used entry would be evicted when it is full.
+	Size int
+
+	// Expiration time of entries in the near cache, 10 seconds if not set.
+	// It bounds how long an entry could be stale if invalidation messages are lost.
+	Expiration time.Duration
+
+	// Pub/sub channel for invalidation messages, "gorelib:near" if not set.
+	// Near caches sharing the channel evict entries for each other.
+	Channel string
+
+	// Interval to re-sync subscriptions with the redis instances of the connector, 10 seconds if not set.
+	// Instances back alive or added since the last sync would be subscribed, purging the near cache.
+	Resync time.Duration
+}
+
+// An entry of the near cache
+type nearEntry struct {
+	bkey string
+	bval []byte
+	serial int64
+	negative bool
+	tags []string
+	expireAt time.Time
+}
+
+// Number of stripes of invalidation epochs
+const nearStripes = 256
+
+// NearCache is an in-process LRU tier in front of a Cache, for read-heavy workloads.
+// While a process has a NearCache over a Cache, or its namespace views, every write through them
+// is published on a redis pub/sub channel, evicting the key from near caches of other processes.
+// Tag invalidations, including Flush of namespaces, are published as well, evicting entries carrying the tag.
+// Writes of processes without a NearCache are not published, so they would be seen after the near cache expiration.
+// Publishing is best effort, failures of it are ignored since the write itself succeeded.
+// Subscriptions are made on every redis instance the connector has, re-synced periodically,
+// and messages are published on the instance of each key, so the connector should be a BroadcastConnector.
+type NearCache struct {
+	cache *Cache
+	options NearOptions
+
+	mx sync.Mutex
+	lru *list.List
+	entries map[string]*list.Element
+
+	// Epochs of invalidations, striped by keys.
+	// Fetched values are not cached if an invalidation for the stripe arrives while fetching.
+	epochs [nearStripes]uint64
+
+	// Redis instances subscribed, by their networks and addresses.
+	// Only the resync goroutine touches it after the creation.
+	subscribed map[string]bool
+
+	done chan struct{}
+	wg sync.WaitGroup
+
+	// Counter of hits in the near cache
+	hits int64
+}
+
+// Generate a near cache over the Cache with given options.
+// It subscribes the invalidation channel on every redis instance of the connector.
+func NewNearCache(cache *Cache, options *NearOptions) (*NearCache, error) {
+	bc, ok := cache.connector.(BroadcastConnector)
+	if !ok {
+		return nil, ErrNoBroadcast
+	}
+
+	n := &NearCache{
+		cache: cache,
+		lru: list.New(),
+		entries: make(map[string]*list.Element),
+		subscribed: make(map[string]bool),
+		done: make(chan struct{}),
+	}
+	if options != nil {
+		n.options = *options
+	}
+	if n.options.Size <= 0 {
+		n.options.Size = 10000
+	}
+	if n.options.Expiration <= 0 {
+		n.options.Expiration = 10 * time.Second
+	}
+	if n.options.Channel == "" {
+		n.options.Channel = "gorelib:near"
+	}
+	if n.options.Resync <= 0 {
+		n.options.Resync = 10 * time.Second
+	}
+
+	conns := bc.ConnectAll(context.Background())
+	for i := range conns {
+		if conns[i].Err != nil {
+			disconnectAll(conns)
+			return nil, conns[i].Err
+		}
+	}
+	n.subscribeAll(conns)
+	disconnectAll(conns)
+
+	n.wg.Add(1)
+	go n.resync(bc)
+	cache.near.add(n)
+	return n, nil
+}
+
+// Cache returns the underlying Cache.
+func (n *NearCache) Cache() *Cache {
+	return n.cache
+}
+
+// Hits returns the near cache hit counter.
+// Misses of the near cache are counted as hits or misses of the underlying Cache.
+func (n *NearCache) Hits() int64 {
+	return atomic.LoadInt64(&n.hits)
+}
+
+// Get returns a cached value like Cache.Get, from the near cache if possible.
+func (n *NearCache) Get(key interface{}, val interface{}) (int64, error) {
+	return n.GetContext(context.Background(), key, val)
+}
+
+// GetContext is same with Get within the context.
+func (n *NearCache) GetContext(ctx context.Context, key interface{}, val interface{}) (int64, error) {
+	bkey, err := n.cache.marshalKey(key)
+	if err != nil {
+		return 0, err
+	}
+	if e, ok := n.lookup(string(bkey)); ok {
+		atomic.AddInt64(&n.hits, 1)
+		if e.negative {
+			return e.serial, ErrNegative
+		}
+		if err := n.cache.options.Unmarshal(e.bval, val); err != nil {
+			return 0, err
+		}
+		return e.serial, nil
+	}
+
+	epoch := n.epoch(string(bkey))
+	bval, it, err := n.cache.fetch(ctx, key, bkey, 0, n.cache.options.Loader)
+	if err != nil && err != ErrNegative {
+		return it.serial, err
+	}
+	n.store(&nearEntry{
+		bkey: string(bkey),
+		bval: bval,
+		serial: it.serial,
+		negative: err == ErrNegative,
+		tags: tagsOf(it.data),
+	}, epoch)
+	if err != nil {
+		return it.serial, err
+	}
+	if err := n.cache.options.Unmarshal(bval, val); err != nil {
+		return 0, err
+	}
+	return it.serial, nil
+}
+
+// Set puts a value with a key like Cache.Set, which evicts the key from near caches.
+func (n *NearCache) Set(key interface{}, val interface{}, opts ...SetOption) (int64, error) {
+	return n.SetContext(context.Background(), key, val, opts...)
+}
+
+// SetContext is same with Set within the context.
+func (n *NearCache) SetContext(ctx context.Context, key interface{}, val interface{}, opts ...SetOption) (int64, error) {
+	return n.cache.SetContext(ctx, key, val, opts...)
+}
+
+// CheckAndSet puts a value with a key like Cache.CheckAndSet, which evicts the key from near caches.
+func (n *NearCache) CheckAndSet(key interface{}, val interface{}, oserial int64, opts ...SetOption) (int64, error) {
+	return n.CheckAndSetContext(context.Background(), key, val, oserial, opts...)
+}
+
+// CheckAndSetContext is same with CheckAndSet within the context.
+func (n *NearCache) CheckAndSetContext(ctx context.Context, key interface{}, val interface{}, oserial int64, opts ...SetOption) (int64, error) {
+	return n.cache.CheckAndSetContext(ctx, key, val, oserial, opts...)
+}
+
+// Del removes a cached value like Cache.Del, which evicts the key from near caches.
+func (n *NearCache) Del(key interface{}) error {
+	return n.DelContext(context.Background(), key)
+}
+
+// DelContext is same with Del within the context.
+func (n *NearCache) DelContext(ctx context.Context, key interface{}) error {
+	return n.cache.DelContext(ctx, key)
+}
+
+// Dispose the near cache, closing its subscriptions.
+// Writes through the underlying Cache are no longer published for it.
+// The underlying Cache is not affected otherwise.
+func (n *NearCache) Shutdown() {
+	n.cache.near.remove(n)
+	close(n.done)
+	n.wg.Wait()
+	n.purge()
+}
+
+// Look up a live entry for the key, marking it recently used.
+func (n *NearCache) lookup(bkey string) (*nearEntry, bool) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	elem, ok := n.entries[bkey]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*nearEntry)
+	if time.Now().After(e.expireAt) {
+		n.lru.Remove(elem)
+		delete(n.entries, bkey)
+		return nil, false
+	}
+	n.lru.MoveToFront(elem)
+	return e, true
+}
+
+// Store an entry fetched since the epoch, unless an invalidation for the stripe arrived in the meantime.
+func (n *NearCache) store(e *nearEntry, epoch uint64) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	if n.epochs[stripeOf(e.bkey)] != epoch {
+		return
+	}
+	e.expireAt = time.Now().Add(n.options.Expiration)
+	if elem, ok := n.entries[e.bkey]; ok {
+		if elem.Value.(*nearEntry).serial > e.serial {
+			return
+		}
+		elem.Value = e
+		n.lru.MoveToFront(elem)
+		return
+	}
+	n.entries[e.bkey] = n.lru.PushFront(e)
+	for n.lru.Len() > n.options.Size {
+		oldest := n.lru.Back()
+		n.lru.Remove(oldest)
+		delete(n.entries, oldest.Value.(*nearEntry).bkey)
+	}
+}
+
+// Returns the current epoch of the stripe for the key.
+func (n *NearCache) epoch(bkey string) uint64 {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	return n.epochs[stripeOf(bkey)]
+}
+
+// Evict an entry for the key older than the serial, or regardless of its serial if zero.
+func (n *NearCache) evict(bkey string, serial int64) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	n.epochs[stripeOf(bkey)]++
+	if elem, ok := n.entries[bkey]; ok {
+		if serial == 0 || elem.Value.(*nearEntry).serial < serial {
+			n.lru.Remove(elem)
+			delete(n.entries, bkey)
+		}
+	}
+}
+
+// Evict entries carrying the tag.
+// Epochs of all the stripes are bumped, since values being fetched might carry the tag.
+func (n *NearCache) evictTag(tag string) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	for i := range n.epochs {
+		n.epochs[i]++
+	}
+	for elem := n.lru.Front(); elem != nil; {
+		next := elem.Next()
+		e := elem.Value.(*nearEntry)
+		for _, t := range e.tags {
+			if t == tag {
+				n.lru.Remove(elem)
+				delete(n.entries, e.bkey)
+				break
+			}
+		}
+		elem = next
+	}
+}
+
+// Evict all the entries, which might have missed invalidations.
+func (n *NearCache) purge() {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	for i := range n.epochs {
+		n.epochs[i]++
+	}
+	n.lru.Init()
+	n.entries = make(map[string]*list.Element)
+}
+
+func stripeOf(bkey string) int {
+	h := fnv.New32a()
+	h.Write([]byte(bkey))
+	return int(h.Sum32() % nearStripes)
+}
+
+// Near caches over a Cache and its namespace views, which writes through them are published for.
+type nearHub struct {
+	mx sync.Mutex
+	caches map[*NearCache]bool
+}
+
+func (h *nearHub) add(n *NearCache) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	if h.caches == nil {
+		h.caches = make(map[*NearCache]bool)
+	}
+	h.caches[n] = true
+}
+
+func (h *nearHub) remove(n *NearCache) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	delete(h.caches, n)
+}
+
+// Returns the near caches, and their distinct channels.
+func (h *nearHub) list() ([]*NearCache, []string) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	var near []*NearCache
+	var channels []string
+	seen := make(map[string]bool)
+	for n := range h.caches {
+		near = append(near, n)
+		if !seen[n.options.Channel] {
+			seen[n.options.Channel] = true
+			channels = append(channels, n.options.Channel)
+		}
+	}
+	return near, channels
+}
+
+// Publish invalidation messages for the written keys with their new serials, or zero for removed ones,
+// if any near cache is over the Cache. The keys are evicted from near caches of the process at once.
+// Messages are formatted as the serial and the marshaled key, separated by a space.
+// Failures are ignored, then entries of other processes would be evicted by the near cache expiration.
+func (c *Cache) notify(ctx context.Context, bkeys [][]byte, serials []int64) {
+	near, channels := c.near.list()
+	if len(near) == 0 || len(bkeys) == 0 {
+		return
+	}
+	for _, n := range near {
+		for i, bkey := range bkeys {
+			n.evict(string(bkey), serials[i])
+		}
+	}
+
+	errs := make(MultiError, len(bkeys))
+	eachConn(c.connectBatch(ctx, bkeys), errs, func(conn *Conn) {
+		Roundtrip(ctx, conn.Client, func() *redis.Resp {
+			for _, idx := range conn.Keys {
+				message := strconv.FormatInt(serials[idx], 10) + " " + string(bkeys[idx])
+				for _, channel := range channels {
+					conn.Client.PipeAppend("PUBLISH", channel, message)
+				}
+			}
+			var resp *redis.Resp
+			for i := 0; i < len(conn.Keys) * len(channels); i++ {
+				if r := conn.Client.PipeResp(); r.Err != nil && resp == nil {
+					resp = r
+				}
+			}
+			if resp == nil {
+				resp = redis.NewResp(nil)
+			}
+			return resp
+		})
+	})
+}
+
+// Publish an invalidation message for the tag, if any near cache is over the Cache.
+// Entries carrying the tag are evicted from near caches of the process at once.
+// Messages are formatted as "tag" and the tag, separated by a space, on the instance of the generation counter.
+func (c *Cache) notifyTag(ctx context.Context, tag string) {
+	near, channels := c.near.list()
+	if len(near) == 0 {
+		return
+	}
+	for _, n := range near {
+		n.evictTag(tag)
+	}
+
+	client, disconnect, _, err := c.connect(ctx, []byte(tagPrefix + tag))
+	if err != nil {
+		return
+	}
+	defer func(){ if disconnect != nil { disconnect() } }()
+
+	for _, channel := range channels {
+		Roundtrip(ctx, client, func() *redis.Resp { return client.Cmd("PUBLISH", channel, "tag " + tag) })
+	}
+}
+
+// Handle an invalidation message.
+func (n *NearCache) invalidate(message string) {
+	i := strings.IndexByte(message, ' ')
+	if i < 0 {
+		return
+	}
+	if message[:i] == "tag" {
+		n.evictTag(message[i + 1:])
+		return
+	}
+	serial, err := strconv.ParseInt(message[:i], 10, 64)
+	if err != nil {
+		return
+	}
+	n.evict(message[i + 1:], serial)
+}
+
+// Subscribe redis instances of the connections not subscribed yet.
+// A new subscription purges the near cache when it is made, since messages on the instance might be missed.
+func (n *NearCache) subscribeAll(conns []Conn) {
+	for i := range conns {
+		if conns[i].Err != nil {
+			continue
+		}
+		network, addr := conns[i].Client.Network, conns[i].Client.Addr
+		if n.subscribed[network + " " + addr] {
+			continue
+		}
+		n.subscribed[network + " " + addr] = true
+		n.wg.Add(1)
+		go n.subscribe(network, addr)
+	}
+}
+
+// Re-sync subscriptions with the redis instances of the connector periodically until shutdown,
+// so instances not alive at the creation, or added later, would be subscribed.
+// Subscriptions on instances gone keep reconnecting, in case they are back.
+func (n *NearCache) resync(bc BroadcastConnector) {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.options.Resync)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+		conns := bc.ConnectAll(context.Background())
+		n.subscribeAll(conns)
+		disconnectAll(conns)
+	}
+}
+
+// Subscribe the invalidation channel on the redis instance until shutdown.
+// It reconnects on failures, purging the near cache since messages might be missed.
+func (n *NearCache) subscribe(network, addr string) {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		default:
+		}
+
+		client, err := redis.DialTimeout(network, addr, time.Second)
+		if err != nil {
+			n.sleep(time.Second)
+			continue
+		}
+		sub := pubsub.NewSubClient(client)
+		if r := sub.Subscribe(n.options.Channel); r.Err != nil {
+			client.Close()
+			n.sleep(time.Second)
+			continue
+		}
+		n.purge()
+
+		n.receive(sub)
+		client.Close()
+	}
+}
+
+// Receive invalidation messages until shutdown or a failure.
+func (n *NearCache) receive(sub *pubsub.SubClient) {
+	for {
+		r := sub.Receive()
+		select {
+		case <-n.done:
+			return
+		default:
+		}
+		if r.Timeout() {
+			continue
+		}
+		if r.Err != nil {
+			return
+		}
+		if r.Type == pubsub.Message {
+			n.invalidate(r.Message)
+		}
+	}
+}
+
+// Sleep for the duration, or until shutdown.
+func (n *NearCache) sleep(d time.Duration) {
+	select {
+	case <-n.done:
+	case <-time.After(d):
+	}
+}
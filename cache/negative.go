@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrNotFound = errors.New("Not found")
+)
+
+// SetNegative puts a tombstone for an absent entity with a key.
+// Get for the key returns ErrNegative, instead of ErrNoKey, until the tombstone expires.
+// Tombstones are ordered by serials like values, so a later Set always overrides it.
+// Its expiration time is NegativeExpiration of CacheOptions if set, or Expiration.
+// It returns the serial of the tombstone.
+func (c *Cache) SetNegative(key interface{}, opts ...SetOption) (int64, error) {
+	return c.SetNegativeContext(context.Background(), key, opts...)
+}
+
+// SetNegativeContext is same with SetNegative within the context.
+func (c *Cache) SetNegativeContext(ctx context.Context, key interface{}, opts ...SetOption) (int64, error) {
+	bkey, err := c.marshalKey(key)
+	if err != nil {
+		return 0, err
+	}
+	opts = c.negativeOptions(opts)
+	return c.setData(ctx, bkey, c.tombstone(opts), opts)
+}
+
+// Prepend the expiration time of tombstones to options, so the given ones could override it.
+func (c *Cache) negativeOptions(opts []SetOption) []SetOption {
+	if c.options.NegativeExpiration <= 0 {
+		return opts
+	}
+	return append([]SetOption{WithTTL(c.options.NegativeExpiration)}, opts...)
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+var (
+	ErrExpired = errors.New("Expiration time is in the past")
+)
+
+// SetOption overrides cache behaviors for a single Set-like call.
+type SetOption func(*setOptions)
+
+// Options for a single Set-like call.
+type setOptions struct {
+	mode string
+	ttl time.Duration
+	at time.Time
+
+	// Cost to recompute the value, recorded with the value if set
+	cost time.Duration
+
+	// Tags to invalidate the value as a group
+	tags []string
+
+	// Serial given by the caller, instead of the SerialSource
+	serial int64
+}
+
+// WithTTL sets the expiration time of the value, instead of CacheOptions.Expiration.
+// The jitter of CacheOptions would be applied also.
+func WithTTL(ttl time.Duration) SetOption {
+	return func(o *setOptions) {
+		o.mode = "px"
+		o.ttl = ttl
+	}
+}
+
+// KeepTTL keeps the current expiration time of the key.
+// If the key does not exist, CacheOptions.Expiration would be applied.
+func KeepTTL() SetOption {
+	return func(o *setOptions) {
+		o.mode = "keep"
+	}
+}
+
+// NoExpiry makes the key persistent, removing its expiration time if any.
+func NoExpiry() SetOption {
+	return func(o *setOptions) {
+		o.mode = "persist"
+	}
+}
+
+// ExpireAt sets the absolute expiration time of the key.
+// The jitter of CacheOptions would not be applied.
+// Set-like calls with a time in the past would fail with ErrExpired.
+func ExpireAt(at time.Time) SetOption {
+	return func(o *setOptions) {
+		o.mode = "pxat"
+		o.at = at
+	}
+}
+
+// WithTags attaches tags to the value, so InvalidateTag with any of them would invalidate it.
+// Tags of multiple WithTags options are accumulated.
+func WithTags(tags ...string) SetOption {
+	return func(o *setOptions) {
+		o.tags = append(o.tags, tags...)
+	}
+}
+
+// Record the cost to recompute the value, for the early recomputation.
+func withCost(cost time.Duration) SetOption {
+	return func(o *setOptions) {
+		o.cost = cost
+	}
+}
+
+// Use the serial given by the caller for the value.
+func withSerial(serial int64) SetOption {
+	return func(o *setOptions) {
+		o.serial = serial
+	}
+}
+
+// Build options for a Set-like call.
+func (c *Cache) setOptions(opts []SetOption) *setOptions {
+	o := &setOptions{
+		mode: "px",
+		ttl: c.options.Expiration,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Returns the history depth and the serial floor of versions to keep with a new serial.
+func (c *Cache) retention(serial int64) (int, int64) {
+	depth := c.options.HistoryDepth
+	if depth <= 0 {
+		depth = 10
+	}
+	var floor int64
+	if c.options.MaxVersionAge > 0 {
+		floor = serial - int64(c.options.MaxVersionAge / time.Microsecond)
+	}
+	return depth, floor
+}
+
+// Returns an expiration mode and time in millis of options for the lua expire function.
+// The jitter is drawn for each call, so call it for each value to spread their expirations.
+func (c *Cache) expiration(opts []SetOption) (string, int64, error) {
+	o := c.setOptions(opts)
+	switch o.mode {
+	case "pxat":
+		if !o.at.After(time.Now()) {
+			return "", 0, ErrExpired
+		}
+		return o.mode, o.at.UnixNano() / int64(time.Millisecond), nil
+	case "persist":
+		return o.mode, 0, nil
+	case "keep":
+		o.ttl = c.options.Expiration
+	}
+	if o.ttl <= 0 {
+		return o.mode, 0, nil
+	}
+	if c.options.ExpirationJitter > 0 {
+		o.ttl += time.Duration(rand.Int63n(int64(c.options.ExpirationJitter)))
+	}
+	ms := int64(o.ttl / time.Millisecond)
+	if ms < 1 {
+		ms = 1
+	}
+	return o.mode, ms, nil
+}
@@ -0,0 +1,212 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	. "github.com/beatuslapis/gorelib.v0/connector"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// Connect to the replicas of the key, the primary first.
+// If the connector is not a ReplicaConnector, the key would have a single replica.
+func (c *Cache) connectReplicas(ctx context.Context, bkey []byte) []Conn {
+	if rc, ok := c.connector.(ReplicaConnector); ok {
+		if err := ctx.Err(); err != nil {
+			return []Conn{{Err: err}}
+		}
+		return rc.ConnectReplicas(ctx, bkey)
+	}
+	var conn Conn
+	conn.Client, conn.Disconnect, conn.ValidSince, conn.Err = c.connect(ctx, bkey)
+	return []Conn{conn}
+}
+
+// Returns whether keys are replicated to multiple redis instances by the connector.
+func (c *Cache) replicated() bool {
+	rc, ok := c.connector.(ReplicaConnector)
+	return ok && rc.Replicas() > 1
+}
+
+// Connect to the replicas of each key, for writes of multiple keys.
+func (c *Cache) connectEachReplicas(ctx context.Context, bkeys [][]byte) [][]Conn {
+	replicas := make([][]Conn, len(bkeys))
+	for i, bkey := range bkeys {
+		replicas[i] = c.connectReplicas(ctx, bkey)
+	}
+	return replicas
+}
+
+// Run fn for the replicas of each key concurrently, with the primary of them, and dispose connections.
+// Keys without any connected replica would have the connection error of the first one.
+func eachKeyReplicas(replicas [][]Conn, errs MultiError, fn func(i int, conns []Conn, primary *Conn) error) {
+	var wg sync.WaitGroup
+	for i := range replicas {
+		primary := firstConnected(replicas[i])
+		if primary == nil {
+			errs[i] = replicas[i][0].Err
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer disconnectAll(replicas[i])
+			errs[i] = fn(i, replicas[i], primary)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Returns the first connected one of the connections, or nil.
+func firstConnected(conns []Conn) *Conn {
+	for i := range conns {
+		if conns[i].Err == nil {
+			return &conns[i]
+		}
+	}
+	return nil
+}
+
+// Run fn for each connected replica concurrently, and returns errors in the order of replicas.
+// Failed connections would have their connection errors.
+func eachReplica(conns []Conn, fn func(i int, conn *Conn) error) []error {
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for i := range conns {
+		if conns[i].Err != nil {
+			errs[i] = conns[i].Err
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(i, &conns[i])
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Write to the primary with write, then to the other replicas with rest, or write again if nil.
+// Failures on the other replicas are ignored, since they would be repaired by reads.
+func replicate(conns []Conn, primary *Conn, write func(conn *Conn) error, rest func(conn *Conn) error) error {
+	if err := write(primary); err != nil {
+		return err
+	}
+	if rest == nil {
+		rest = write
+	}
+	eachReplica(conns, func(i int, conn *Conn) error {
+		if conn == primary {
+			return nil
+		}
+		return rest(conn)
+	})
+	return nil
+}
+
+// Fetch a decoded value from ReadReplicas of the replicas of the key, returning the newest one.
+// Replicas with older values, or without the value, would be repaired in background.
+func (c *Cache) fetchReplicas(ctx context.Context, key interface{}, bkey []byte, minSerial int64, loader Loader) ([]byte, item, error) {
+	conns := c.connectReplicas(ctx, bkey)
+	if len(conns) > c.options.ReadReplicas {
+		disconnectAll(conns[c.options.ReadReplicas:])
+		conns = conns[:c.options.ReadReplicas]
+	}
+
+	resps := make([]*redis.Resp, len(conns))
+	errs := eachReplica(conns, func(i int, conn *Conn) error {
+		resps[i] = luaEval(ctx, conn.Client, luaForGet, 1, bkey, conn.ValidSince, minSerial - 1)
+		return resps[i].Err
+	})
+
+	best := -1
+	serials := make([]int64, len(conns))
+	for i := range conns {
+		if errs[i] != nil {
+			continue
+		}
+		if _, serial, _, ok := rawGet(resps[i]); ok {
+			serials[i] = serial
+			if best < 0 || serial > serials[best] {
+				best = i
+			}
+		}
+	}
+	if best < 0 {
+		disconnectAll(conns)
+		for i := range conns {
+			if errs[i] == nil {
+				return c.parseGet(bkey, resps[i], conns[i].ValidSince)
+			}
+		}
+		return nil, item{}, errs[0]
+	}
+
+	var lagging []*Conn
+	for i := range conns {
+		if errs[i] == nil && serials[i] < serials[best] {
+			lagging = append(lagging, &conns[i])
+		}
+	}
+	if len(lagging) > 0 {
+		go func() {
+			defer disconnectAll(conns)
+			c.repair(bkey, resps[best], lagging)
+		}()
+	} else {
+		disconnectAll(conns)
+	}
+
+	bval, it, err := c.parseGet(bkey, resps[best], conns[best].ValidSince)
+	if err == nil || err == ErrNegative {
+		c.revalidate(key, bkey, it, loader)
+	}
+	return bval, it, err
+}
+
+// Returns the stored value, its serial and remaining time to live in millis of a reply of the get function,
+// if it is a hit.
+func rawGet(resp *redis.Resp) ([]byte, int64, int64, bool) {
+	res, err := resp.Array()
+	if err != nil || len(res) != 3 {
+		return nil, 0, 0, false
+	}
+	data, err := res[0].Bytes()
+	if err != nil {
+		return nil, 0, 0, false
+	}
+	serial, err := res[1].Int64()
+	if err != nil {
+		return nil, 0, 0, false
+	}
+	pttl, _ := res[2].Int64()
+	return data, serial, pttl, true
+}
+
+// Repair lagging replicas with the newest value read from another replica.
+// The value is stored with its own serial and remaining time to live, so a newer one would not be overwritten.
+// Since generations of tags differ by redis instances, tags of a tagged value are recorded anew
+// with the current generations of each lagging replica.
+func (c *Cache) repair(bkey []byte, resp *redis.Resp, lagging []*Conn) {
+	data, serial, pttl, ok := rawGet(resp)
+	if !ok {
+		return
+	}
+	tags := ""
+	if list := tagsOf(data); len(list) > 0 {
+		btags, _ := json.Marshal(list)
+		tags = string(btags)
+	}
+	data = stripTags(data)
+	mode, ms := "px", pttl
+	if pttl < 0 {
+		mode, ms = "persist", 0
+	}
+	depth, floor := c.retention(serial)
+	for _, conn := range lagging {
+		luaEval(context.Background(), conn.Client, luaForSet, 1, bkey, data, serial, mode, ms, depth, floor, tags)
+	}
+}
@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	. "github.com/beatuslapis/gorelib.v0/connector"
+)
+
+var (
+	ErrInvalidCursor = errors.New("Invalid scan cursor")
+)
+
+// Lua script for scanning cached values on a redis instance.
+// It returns the next SCAN cursor, followed by keys and serials of their newest versions.
+// Keys not of cached values, not written after the validity serial, or invalidated by tags, are excluded like Get.
+const luaForScan = luaValidFunc + luaWrittenFunc + luaCurrentFunc +
+	"local r=redis.call('SCAN', ARGV[1], 'MATCH', ARGV[2], 'COUNT', ARGV[3]) " +
+	"local res={r[1]} " +
+	"for _, key in ipairs(r[2]) do " +
+	"  local cur=current(key) " +
+	"  if cur[2] and written(cur[1], cur[2]) > tonumber(ARGV[4]) and valid(cur[1]) then " +
+	"    res[#res+1]=key " +
+	"    res[#res+1]=math.floor(cur[2]) " +
+	"  end " +
+	"end " +
+	"return res "
+
+// Number of keys to scan for a batch on a redis instance
+const scanCount = 100
+
+// A key found by the scan
+type scanItem struct {
+	bkey []byte
+	serial int64
+}
+
+// Scanner iterates cached values over all the redis instances of the connector, one instance after another.
+// Like SCAN of redis, a key might be returned more than once, and keys changed while scanning might be missed.
+// Values which Get would regard as misses, i.e. stale or invalidated ones, are skipped.
+// With replicated writes, a key is returned once for each replica.
+type Scanner struct {
+	cache *Cache
+	pattern string
+
+	// Position of the next batch, an instance address and its SCAN cursor
+	addr string
+	cursor string
+
+	// Cursor of the current batch
+	batch string
+
+	items []scanItem
+	cur scanItem
+
+	done bool
+	err error
+}
+
+// Scan returns a Scanner of cached values whose marshaled keys match the glob-style pattern of redis.
+// Note that keys are matched as marshaled, so string keys with the default Marshal are in double quotes.
+// For a namespace view, the pattern applies to keys without the prefix, and only keys in the namespace are scanned.
+// The connector should be a BroadcastConnector.
+func (c *Cache) Scan(pattern string) *Scanner {
+	return &Scanner{
+		cache: c,
+		pattern: pattern,
+		cursor: "0",
+	}
+}
+
+// ScanFrom returns a Scanner resuming from the cursor which Cursor of a Scanner returned.
+// The pattern should be the same with the original one.
+func (c *Cache) ScanFrom(pattern string, cursor string) (*Scanner, error) {
+	s := c.Scan(pattern)
+	if cursor == "" {
+		return s, nil
+	}
+	i := strings.IndexByte(cursor, '@')
+	if i <= 0 || i == len(cursor) - 1 {
+		return nil, ErrInvalidCursor
+	}
+	s.cursor, s.addr = cursor[:i], cursor[i + 1:]
+	return s, nil
+}
+
+// Next advances to the next cached value, fetching a batch from redis if needed.
+// It returns false when the scan is completed or an error occurs. Check Err for the latter.
+func (s *Scanner) Next() bool {
+	return s.NextContext(context.Background())
+}
+
+// NextContext is same with Next within the context.
+func (s *Scanner) NextContext(ctx context.Context) bool {
+	for len(s.items) == 0 {
+		if s.done || s.err != nil {
+			return false
+		}
+		s.fetch(ctx)
+	}
+	s.cur, s.items = s.items[0], s.items[1:]
+	return true
+}
+
+// Key unmarshals the key of the current value.
+func (s *Scanner) Key(key interface{}) error {
+	if !bytes.HasPrefix(s.cur.bkey, s.cache.prefix) {
+		return ErrRESPParse
+	}
+	return s.cache.options.Unmarshal(s.cur.bkey[len(s.cache.prefix):], key)
+}
+
+// Serial returns the serial of the newest version of the current value.
+func (s *Scanner) Serial() int64 {
+	return s.cur.serial
+}
+
+// Cursor returns a composite cursor, of an instance address and its SCAN cursor, for the batch of the current value.
+// Scanners resumed with it would begin with the batch, so some keys might be returned again.
+func (s *Scanner) Cursor() string {
+	return s.batch
+}
+
+// Err returns the error which stopped the scan, if any.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// Fetch the next batch from the instance of the position,
+// then advance the position to the next instance if the instance is completed.
+func (s *Scanner) fetch(ctx context.Context) {
+	bc, ok := s.cache.connector.(BroadcastConnector)
+	if !ok {
+		s.err = ErrNoBroadcast
+		return
+	}
+	if err := ctx.Err(); err != nil {
+		s.err = err
+		return
+	}
+	addrs, err := bc.Addrs(ctx)
+	if err != nil {
+		s.err = err
+		return
+	}
+
+	// The instance of the position, or the next one if it is gone
+	idx := sort.SearchStrings(addrs, s.addr)
+	if idx == len(addrs) {
+		s.done = true
+		return
+	}
+	if addrs[idx] != s.addr {
+		s.addr, s.cursor = addrs[idx], "0"
+	}
+	s.batch = s.cursor + "@" + s.addr
+
+	conn := bc.ConnectAddr(ctx, s.addr)
+	if conn.Err != nil {
+		s.err = conn.Err
+		return
+	}
+	defer func(){ if conn.Disconnect != nil { conn.Disconnect() } }()
+
+	pattern := globEscape(string(s.cache.prefix)) + s.pattern
+	res, err := luaEval(ctx, conn.Client, luaForScan, 0, s.cursor, pattern, scanCount, conn.ValidSince).Array()
+	if err != nil {
+		s.err = err
+		return
+	}
+	if len(res) % 2 != 1 {
+		s.err = ErrRESPParse
+		return
+	}
+	if s.cursor, err = res[0].Str(); err != nil {
+		s.err = ErrRESPParse
+		return
+	}
+	for i := 1; i < len(res); i += 2 {
+		bkey, err := res[i].Bytes()
+		if err != nil {
+			s.err = ErrRESPParse
+			return
+		}
+		serial, err := res[i+1].Int64()
+		if err != nil {
+			s.err = ErrRESPParse
+			return
+		}
+		s.items = append(s.items, scanItem{bkey: bkey, serial: serial})
+	}
+
+	if s.cursor == "0" {
+		if idx + 1 < len(addrs) {
+			s.addr = addrs[idx + 1]
+		} else {
+			s.done = true
+		}
+	}
+}
+
+// Escape special characters of the glob-style pattern of redis, to match the string literally.
+func globEscape(str string) string {
+	var b strings.Builder
+	for i := 0; i < len(str); i++ {
+		switch str[i] {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(str[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,183 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+var (
+	ErrInvalidSerial = errors.New("Serial should be positive")
+)
+
+// SerialSource generates serials for values to store.
+// Values of a key are ordered by their serials, and the newest one wins.
+// Serials are regarded as unix timestamps in micros for the expiration-related features,
+// such as SoftExpiration and MaxVersionAge, so sources should keep the unit roughly.
+type SerialSource interface {
+	// Serial returns a new serial for a value to store on the redis instance of the client.
+	Serial(ctx context.Context, client *redis.Client) (int64, error)
+
+	// Observe folds a serial of a value read from the cache into the source.
+	Observe(serial int64)
+}
+
+// WallClock is a SerialSource with the local wall clock in micros, the default one.
+// Clock skews between hosts could make a stale write win, or a fresh write fail.
+type WallClock struct{}
+
+func (WallClock) Serial(ctx context.Context, client *redis.Client) (int64, error) {
+	return getSerial(), nil
+}
+
+func (WallClock) Observe(serial int64) {}
+
+// HybridClock is a SerialSource with a hybrid logical clock in micros.
+// It never goes backward, and it always generates a serial newer than any observed one,
+// so a write following a read of the process would win over the read value even with clock skews.
+// The zero value is ready to use, and it should be shared rather than copied.
+type HybridClock struct {
+	mx sync.Mutex
+	last int64
+}
+
+func (h *HybridClock) Serial(ctx context.Context, client *redis.Client) (int64, error) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	serial := getSerial()
+	if serial <= h.last {
+		serial = h.last + 1
+	}
+	h.last = serial
+	return serial, nil
+}
+
+func (h *HybridClock) Observe(serial int64) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	if serial > h.last {
+		h.last = serial
+	}
+}
+
+// Prefix of the redis key for the last serial of RedisClock.
+const redisClockKey = "gorelib:serial"
+
+// Lua script for generating a serial with the clock of the redis instance.
+// It takes TIME in micros, but never goes backward from the last one stored on the instance.
+const luaForRedisClock =
+	"redis.replicate_commands() " +
+	"local t=redis.call('TIME') " +
+	"local serial=tonumber(t[1]) * 1000000 + tonumber(t[2]) " +
+	"local last=tonumber(redis.call('GET', KEYS[1]) or 0) " +
+	"if serial <= last then " +
+	"  serial=last + 1 " +
+	"end " +
+	"redis.call('SET', KEYS[1], serial) " +
+	"return serial "
+
+// RedisClock is a SerialSource with the clock of the redis instance which a value is stored on.
+// Since all the writes for a key go to the same instance, they are ordered by a single clock,
+// and serials of an instance are strictly increasing. It costs a round trip for each write.
+// Note that keys moved to another instance by failover are ordered by another clock.
+type RedisClock struct{}
+
+func (RedisClock) Serial(ctx context.Context, client *redis.Client) (int64, error) {
+	return luaEval(ctx, client, luaForRedisClock, 1, redisClockKey).Int64()
+}
+
+func (RedisClock) Observe(serial int64) {}
+
+// Lua function for the time when a value is written, to compare with validity serials.
+// It is the recorded one for a value with a serial given by the caller, or the serial otherwise.
+const luaWrittenFunc =
+	"local function written(val, serial) " +
+	"  if string.sub(val, 1, 2) == '\\0T' then " +
+	"    val=string.sub(val, 7 + struct.unpack('>I4', string.sub(val, 3, 6))) " +
+	"  end " +
+	"  if string.sub(val, 1, 2) == '\\0W' and #val >= 10 then " +
+	"    return struct.unpack('>I8', string.sub(val, 3, 10)) " +
+	"  end " +
+	"  return tonumber(serial) " +
+	"end "
+
+// Lua function for dropping the recorded time of writing from a value, keeping its tags.
+const luaUnwrittenFunc =
+	"local function unwritten(val) " +
+	"  local hdr='' " +
+	"  if string.sub(val, 1, 2) == '\\0T' then " +
+	"    local n=6 + struct.unpack('>I4', string.sub(val, 3, 6)) " +
+	"    hdr, val=string.sub(val, 1, n), string.sub(val, n + 1) " +
+	"  end " +
+	"  if string.sub(val, 1, 2) == '\\0W' and #val >= 10 then " +
+	"    val=string.sub(val, 11) " +
+	"  end " +
+	"  return hdr .. val " +
+	"end "
+
+// returns the local wall clock in micros
+func getSerial() int64 {
+	return time.Now().UnixNano() / int64(time.Microsecond)
+}
+
+// Generate a new serial for a value to store with the client, unless the options have one.
+func (c *Cache) serial(ctx context.Context, client *redis.Client, opts []SetOption) (int64, error) {
+	if serial := c.setOptions(opts).serial; serial > 0 {
+		return serial, nil
+	}
+	if c.options.SerialSource == nil {
+		return getSerial(), nil
+	}
+	return c.options.SerialSource.Serial(ctx, client)
+}
+
+// Fold a serial read from the cache into the serial source.
+func (c *Cache) observe(serial int64) {
+	if c.options.SerialSource != nil {
+		c.options.SerialSource.Observe(serial)
+	}
+}
+
+// SetWithSerial puts a value with a key like Set, but with the serial given by the caller,
+// such as a row version of the database or an offset of the change log.
+// Writes are then ordered by the versions of the source of truth, regardless of their arrival order.
+// Since an equal serial is not regarded as newer, a redelivered write would succeed again.
+// The serial should be positive, and features regarding serials as timestamps,
+// like SoftExpiration and MaxVersionAge, would not work properly with non-timestamp serials.
+// The local wall clock is recorded with the value, so validity serials of the connector,
+// such as ones of a Cluster after failover, are compared with the time of writing rather than the serial.
+// Keys written with SetWithSerial should not be written by the cache with serials of the SerialSource,
+// i.e. loaded by GetOrLoad or Loader, refreshed in background, or written by Set-like calls, Update,
+// WriteThrough or WriteBehind. A timestamp serial would be newer than serials of the source of truth,
+// so SetWithSerial for the key would fail with ErrSetFailed until the value expires.
+func (c *Cache) SetWithSerial(key interface{}, val interface{}, serial int64, opts ...SetOption) (int64, error) {
+	return c.SetWithSerialContext(context.Background(), key, val, serial, opts...)
+}
+
+// SetWithSerialContext is same with SetWithSerial within the context.
+func (c *Cache) SetWithSerialContext(ctx context.Context, key interface{}, val interface{}, serial int64, opts ...SetOption) (int64, error) {
+	if serial <= 0 {
+		return 0, ErrInvalidSerial
+	}
+	return c.SetContext(ctx, key, val, append(opts, withSerial(serial))...)
+}
+
+// CheckAndSetWithSerial puts a value with a key like CheckAndSet, but with the new serial given by the caller.
+// It fails with ErrSetFailed if the stored value is newer than either of the serials.
+// Keys written with it should not be written by the cache with serials of the SerialSource, like SetWithSerial.
+func (c *Cache) CheckAndSetWithSerial(key interface{}, val interface{}, oserial int64, nserial int64, opts ...SetOption) (int64, error) {
+	return c.CheckAndSetWithSerialContext(context.Background(), key, val, oserial, nserial, opts...)
+}
+
+// CheckAndSetWithSerialContext is same with CheckAndSetWithSerial within the context.
+func (c *Cache) CheckAndSetWithSerialContext(ctx context.Context, key interface{}, val interface{}, oserial int64, nserial int64, opts ...SetOption) (int64, error) {
+	if nserial <= 0 {
+		return 0, ErrInvalidSerial
+	}
+	return c.CheckAndSetContext(ctx, key, val, oserial, append(opts, withSerial(nserial))...)
+}
@@ -0,0 +1,414 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	ErrShutdown = errors.New("Write-behind cache is shut down")
+)
+
+// Store is a backing store, the source of truth of cached values.
+type Store interface {
+	// Load reads a value for the key, or returns ErrNotFound if it does not exist.
+	Load(key interface{}) (interface{}, error)
+
+	// Save writes a value for the key with the serial the Cache gave it.
+	// Stores could ignore writes older than the stored one with serials, for out-of-order writes.
+	Save(key interface{}, val interface{}, serial int64) error
+
+	// Delete removes a value for the key.
+	Delete(key interface{}) error
+}
+
+// WriteThrough is a Cache in front of a Store, which writes values to both synchronously.
+// Misses are loaded from the Store like GetOrLoad.
+type WriteThrough struct {
+	cache *Cache
+	store Store
+}
+
+// Generate a write-through cache over the Cache and the Store.
+func NewWriteThrough(cache *Cache, store Store) *WriteThrough {
+	return &WriteThrough{
+		cache: cache,
+		store: store,
+	}
+}
+
+// Cache returns the underlying Cache.
+func (w *WriteThrough) Cache() *Cache {
+	return w.cache
+}
+
+// Get returns a cached value, loading it from the Store on misses.
+func (w *WriteThrough) Get(key interface{}, val interface{}) (int64, error) {
+	return w.GetContext(context.Background(), key, val)
+}
+
+// GetContext is same with Get within the context.
+func (w *WriteThrough) GetContext(ctx context.Context, key interface{}, val interface{}) (int64, error) {
+	return w.cache.GetOrLoadContext(ctx, key, val, w.store.Load)
+}
+
+// Set puts a value into the Cache, then saves it to the Store with its serial.
+// If the Store fails, the value is removed from the Cache unless a newer one is stored,
+// so the Cache would not serve a value the Store does not have.
+func (w *WriteThrough) Set(key interface{}, val interface{}, opts ...SetOption) (int64, error) {
+	return w.SetContext(context.Background(), key, val, opts...)
+}
+
+// SetContext is same with Set within the context.
+func (w *WriteThrough) SetContext(ctx context.Context, key interface{}, val interface{}, opts ...SetOption) (int64, error) {
+	serial, err := w.cache.SetContext(ctx, key, val, opts...)
+	if err != nil {
+		return 0, err
+	}
+	if err := w.store.Save(key, val, serial); err != nil {
+		w.cache.DelIfSerialContext(ctx, key, serial)
+		return 0, err
+	}
+	return serial, nil
+}
+
+// Del removes a value from the Store, then from the Cache.
+func (w *WriteThrough) Del(key interface{}) error {
+	return w.DelContext(context.Background(), key)
+}
+
+// DelContext is same with Del within the context.
+func (w *WriteThrough) DelContext(ctx context.Context, key interface{}) error {
+	if err := w.store.Delete(key); err != nil {
+		return err
+	}
+	return w.cache.DelContext(ctx, key)
+}
+
+// An option structure to create a write-behind cache
+type WriteBehindOptions struct {
+	// Interval between flushes of pending writes, a second if not set.
+	Interval time.Duration
+
+	// Pending writes more than this would be flushed without waiting for the interval, 100 if not set.
+	BatchSize int
+
+	// Number of retries of a failed write to the Store, 3 if not set.
+	Retries int
+
+	// Backoff between retries, doubled for each retry, 100ms if not set.
+	// A failed write is retried by a later flush after the backoff, without delaying other writes.
+	RetryBackoff time.Duration
+
+	// Called with a write given up after retries, if set.
+	// The write is dropped from pending writes, so misses would load the value of the Store.
+	OnError func(key interface{}, err error)
+}
+
+// A write pending for the Store.
+// Values are kept marshaled, so changes made by the caller after Set would not be saved.
+type pendingWrite struct {
+	key interface{}
+	bval []byte
+	typ reflect.Type
+	serial int64
+	del bool
+
+	// Number of failed attempts, and when to retry after the last one
+	attempts int
+	retryAt time.Time
+}
+
+// Returns a copy of the pending value, unmarshaled into a new value of its original type.
+func (pw *pendingWrite) value(unmarshal func([]byte, interface{}) error) (interface{}, error) {
+	if pw.typ == nil {
+		return nil, nil
+	}
+	ptr := reflect.New(pw.typ)
+	if err := unmarshal(pw.bval, ptr.Interface()); err != nil {
+		return nil, err
+	}
+	return ptr.Elem().Interface(), nil
+}
+
+// WriteBehind is a Cache in front of a Store, which writes values to the Store asynchronously.
+// Pending writes for the same key are coalesced, and only the newest one by serials would be saved.
+// Misses are loaded from the Store like GetOrLoad, or from pending writes if any.
+// Writes stay pending until saved or given up, so misses would not load older values from the Store while flushing.
+// Values are passed to the Store as copies made by Marshal and Unmarshal of CacheOptions.
+type WriteBehind struct {
+	cache *Cache
+	store Store
+	options WriteBehindOptions
+
+	mx sync.Mutex
+	pending map[string]*pendingWrite
+
+	// Number of pending writes waiting for retries, which do not count for BatchSize
+	retrying int
+	closed bool
+
+	kick chan struct{}
+	done chan struct{}
+	wg sync.WaitGroup
+}
+
+// Generate a write-behind cache over the Cache and the Store with given options.
+// Call Shutdown to flush pending writes before exit.
+func NewWriteBehind(cache *Cache, store Store, options *WriteBehindOptions) *WriteBehind {
+	w := &WriteBehind{
+		cache: cache,
+		store: store,
+		pending: make(map[string]*pendingWrite),
+		kick: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	if options != nil {
+		w.options = *options
+	}
+	if w.options.Interval <= 0 {
+		w.options.Interval = time.Second
+	}
+	if w.options.BatchSize <= 0 {
+		w.options.BatchSize = 100
+	}
+	if w.options.Retries <= 0 {
+		w.options.Retries = 3
+	}
+	if w.options.RetryBackoff <= 0 {
+		w.options.RetryBackoff = 100 * time.Millisecond
+	}
+
+	w.wg.Add(1)
+	go w.flusher()
+	return w
+}
+
+// Cache returns the underlying Cache.
+func (w *WriteBehind) Cache() *Cache {
+	return w.cache
+}
+
+// Get returns a cached value, loading it from pending writes or the Store on misses.
+func (w *WriteBehind) Get(key interface{}, val interface{}) (int64, error) {
+	return w.GetContext(context.Background(), key, val)
+}
+
+// GetContext is same with Get within the context.
+func (w *WriteBehind) GetContext(ctx context.Context, key interface{}, val interface{}) (int64, error) {
+	return w.cache.GetOrLoadContext(ctx, key, val, func(key interface{}) (interface{}, error) {
+		if pw, ok := w.lookup(key); ok {
+			if pw.del {
+				return nil, ErrNotFound
+			}
+			return pw.value(w.cache.options.Unmarshal)
+		}
+		return w.store.Load(key)
+	})
+}
+
+// Set puts a value into the Cache, and queues it to be saved to the Store with its serial.
+// After Shutdown, it fails with ErrShutdown without putting the value.
+func (w *WriteBehind) Set(key interface{}, val interface{}, opts ...SetOption) (int64, error) {
+	return w.SetContext(context.Background(), key, val, opts...)
+}
+
+// SetContext is same with Set within the context.
+func (w *WriteBehind) SetContext(ctx context.Context, key interface{}, val interface{}, opts ...SetOption) (int64, error) {
+	if w.isClosed() {
+		return 0, ErrShutdown
+	}
+	bkey, err := w.cache.marshalKey(key)
+	if err != nil {
+		return 0, err
+	}
+	bval, err := w.cache.options.Marshal(val)
+	if err != nil {
+		return 0, err
+	}
+	bval = append([]byte(nil), bval...)
+	serial, err := w.cache.setBytes(ctx, bkey, bval, opts)
+	if err != nil {
+		return 0, err
+	}
+	if err := w.enqueue(&pendingWrite{key: key, bval: bval, typ: reflect.TypeOf(val), serial: serial}); err != nil {
+		w.cache.DelIfSerialContext(ctx, key, serial)
+		return 0, err
+	}
+	return serial, nil
+}
+
+// Del removes a value from the Cache, and queues it to be deleted from the Store.
+// It overrides pending writes for the key.
+// After Shutdown, it fails with ErrShutdown without removing the value.
+func (w *WriteBehind) Del(key interface{}) error {
+	return w.DelContext(context.Background(), key)
+}
+
+// DelContext is same with Del within the context.
+func (w *WriteBehind) DelContext(ctx context.Context, key interface{}) error {
+	if w.isClosed() {
+		return ErrShutdown
+	}
+	if err := w.cache.DelContext(ctx, key); err != nil {
+		return err
+	}
+	return w.enqueue(&pendingWrite{key: key, del: true})
+}
+
+// Dispose the write-behind cache, flushing all the pending writes with their retries.
+// Writes after it fail with ErrShutdown. The underlying Cache is not affected.
+func (w *WriteBehind) Shutdown() {
+	w.mx.Lock()
+	w.closed = true
+	w.mx.Unlock()
+
+	close(w.done)
+	w.wg.Wait()
+}
+
+func (w *WriteBehind) isClosed() bool {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return w.closed
+}
+
+// Queue a write, coalescing it with a pending one for the same key.
+// A pending write is replaced unless it is newer by serials, and the replacement starts over its retries.
+func (w *WriteBehind) enqueue(pw *pendingWrite) error {
+	bkey, err := w.cache.marshalKey(pw.key)
+	if err != nil {
+		return err
+	}
+
+	w.mx.Lock()
+	if w.closed {
+		w.mx.Unlock()
+		return ErrShutdown
+	}
+	if cur, ok := w.pending[string(bkey)]; !ok || pw.del || cur.del || cur.serial <= pw.serial {
+		if ok && cur.attempts > 0 {
+			w.retrying--
+		}
+		w.pending[string(bkey)] = pw
+	}
+	full := len(w.pending) - w.retrying >= w.options.BatchSize
+	w.mx.Unlock()
+
+	if full {
+		select {
+		case w.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Look up a pending write for the key.
+func (w *WriteBehind) lookup(key interface{}) (*pendingWrite, bool) {
+	bkey, err := w.cache.marshalKey(key)
+	if err != nil {
+		return nil, false
+	}
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	pw, ok := w.pending[string(bkey)]
+	return pw, ok
+}
+
+// Flush pending writes periodically, when they are many, or when retries are due, until shutdown.
+// On shutdown, it keeps flushing until all the pending writes are saved or given up.
+func (w *WriteBehind) flusher() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.options.Interval)
+	defer ticker.Stop()
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-w.done:
+			for next := w.flush(); !next.IsZero(); next = w.flush() {
+				time.Sleep(time.Until(next))
+			}
+			return
+		case <-ticker.C:
+		case <-w.kick:
+		case <-retry:
+		}
+		if next := w.flush(); !next.IsZero() {
+			retry = time.After(time.Until(next))
+		} else {
+			retry = nil
+		}
+	}
+}
+
+// Write the pending writes due to the Store as a batch, each attempted once.
+// Each write is removed from pending writes after saved, unless replaced by a newer one in the meantime.
+// A failed write is retried after the backoff, or given up and removed after retries.
+// Writes queued while flushing would be in the next batch.
+// It returns the earliest time of retries pending, or zero if none.
+func (w *WriteBehind) flush() time.Time {
+	now := time.Now()
+	w.mx.Lock()
+	batch := make(map[string]*pendingWrite, len(w.pending))
+	for bkey, pw := range w.pending {
+		if !pw.retryAt.After(now) {
+			batch[bkey] = pw
+		}
+	}
+	w.mx.Unlock()
+
+	for bkey, pw := range batch {
+		err := w.write(pw)
+
+		w.mx.Lock()
+		if w.pending[bkey] != pw {
+			w.mx.Unlock()
+			continue
+		}
+		failed := err != nil && pw.attempts >= w.options.Retries
+		if err == nil || failed {
+			delete(w.pending, bkey)
+			if pw.attempts > 0 {
+				w.retrying--
+			}
+		} else {
+			if pw.attempts == 0 {
+				w.retrying++
+			}
+			pw.attempts++
+			pw.retryAt = time.Now().Add(w.options.RetryBackoff << (pw.attempts - 1))
+		}
+		w.mx.Unlock()
+
+		if failed && w.options.OnError != nil {
+			w.options.OnError(pw.key, err)
+		}
+	}
+
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	var next time.Time
+	for _, pw := range w.pending {
+		if pw.attempts > 0 && (next.IsZero() || pw.retryAt.Before(next)) {
+			next = pw.retryAt
+		}
+	}
+	return next
+}
+
+// Write a pending write to the Store.
+func (w *WriteBehind) write(pw *pendingWrite) error {
+	if pw.del {
+		return w.store.Delete(pw.key)
+	}
+	val, err := pw.value(w.cache.options.Unmarshal)
+	if err != nil {
+		return err
+	}
+	return w.store.Save(pw.key, val, pw.serial)
+}
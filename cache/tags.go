@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+
+	. "github.com/beatuslapis/gorelib.v0/connector"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// Prefix of the redis keys for generation counters of tags.
+// Every redis instance has its own counters for the keys on it.
+const tagPrefix = "gorelib:tag:"
+
+// Lua function for attaching tags to a value to store.
+// It records the current generation of each tag, prepending the tagged header.
+const luaTagFunc =
+	"local function tag(val, tags) " +
+	"  if not tags or tags == '' then " +
+	"    return val " +
+	"  end " +
+	"  local list=cjson.decode(tags) " +
+	"  local gens={} " +
+	"  for i, t in ipairs(list) do " +
+	"    gens[i]=tonumber(redis.call('GET', '" + tagPrefix + "' .. t) or 0) " +
+	"  end " +
+	"  local hdr=cjson.encode({list, gens}) " +
+	"  return '\\0T' .. struct.pack('>I4', #hdr) .. hdr .. val " +
+	"end "
+
+// Lua function for checking tags of a stored value.
+// A value is valid if it has no tags, or every tag has the same generation as recorded.
+const luaValidFunc =
+	"local function valid(val) " +
+	"  if string.sub(val, 1, 2) ~= '\\0T' then " +
+	"    return true " +
+	"  end " +
+	"  local n=struct.unpack('>I4', string.sub(val, 3, 6)) " +
+	"  local hdr=cjson.decode(string.sub(val, 7, 6 + n)) " +
+	"  for i, t in ipairs(hdr[1]) do " +
+	"    if tonumber(redis.call('GET', '" + tagPrefix + "' .. t) or 0) ~= hdr[2][i] then " +
+	"      return false " +
+	"    end " +
+	"  end " +
+	"  return true " +
+	"end "
+
+// Returns tags of options as a script argument, or an empty string if none.
+// Duplicates, like implicit tags of namespaces carried by refreshes, are dropped.
+func (c *Cache) tags(opts []SetOption) string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, list := range [][]string{c.nstags, c.setOptions(opts).tags} {
+		for _, tag := range list {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	btags, _ := json.Marshal(tags)
+	return string(btags)
+}
+
+// InvalidateTag invalidates every value carrying the tag, on all the redis instances of the connector.
+// It bumps the generation counter of the tag on each instance, so Get would miss the values,
+// returning a MissError of ErrInvalidated, without scanning or removing them.
+// Values set after the invalidation carry the new generation, thus valid again.
+// The connector should be a BroadcastConnector.
+func (c *Cache) InvalidateTag(tag string) error {
+	return c.InvalidateTagContext(context.Background(), tag)
+}
+
+// InvalidateTagContext is same with InvalidateTag within the context.
+func (c *Cache) InvalidateTagContext(ctx context.Context, tag string) error {
+	err := c.broadcast(ctx, func(conn *Conn) error {
+		return Roundtrip(ctx, conn.Client, func() *redis.Resp { return conn.Client.Cmd("INCR", tagPrefix + tag) }).Err
+	})
+	if err != ErrNoBroadcast {
+		c.notifyTag(ctx, tag)
+	}
+	return err
+}
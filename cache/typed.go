@@ -0,0 +1,248 @@
+package cache
+
+import (
+	"context"
+)
+
+// TypedCache is a type-safe view of a Cache for keys of K and values of V.
+// Keys and values are marshaled with the CacheOptions of the underlying Cache,
+// so typed and untyped accesses for the same key are interchangeable.
+type TypedCache[K any, V any] struct {
+	cache *Cache
+}
+
+// NewTypedCache returns a TypedCache over the given Cache.
+func NewTypedCache[K any, V any](cache *Cache) *TypedCache[K, V] {
+	return &TypedCache[K, V]{
+		cache: cache,
+	}
+}
+
+// Cache returns the underlying Cache.
+func (t *TypedCache[K, V]) Cache() *Cache {
+	return t.cache
+}
+
+// Get returns a cached value with its serial.
+// On errors, it returns the zero value of V.
+func (t *TypedCache[K, V]) Get(key K) (V, int64, error) {
+	return t.GetContext(context.Background(), key)
+}
+
+// GetContext is same with Get within the context.
+func (t *TypedCache[K, V]) GetContext(ctx context.Context, key K) (V, int64, error) {
+	var val V
+	serial, err := t.cache.GetContext(ctx, key, &val)
+	if err != nil {
+		var zero V
+		return zero, serial, err
+	}
+	return val, serial, nil
+}
+
+// GetWithStale returns a cached value with its serial, flagging whether it is soft-expired like Cache.GetWithStale.
+// On errors, it returns the zero value of V.
+func (t *TypedCache[K, V]) GetWithStale(key K) (V, int64, bool, error) {
+	return t.GetWithStaleContext(context.Background(), key)
+}
+
+// GetWithStaleContext is same with GetWithStale within the context.
+func (t *TypedCache[K, V]) GetWithStaleContext(ctx context.Context, key K) (V, int64, bool, error) {
+	var val V
+	serial, stale, err := t.cache.GetWithStaleContext(ctx, key, &val)
+	if err != nil {
+		var zero V
+		return zero, serial, false, err
+	}
+	return val, serial, stale, nil
+}
+
+// GetMinSerial returns a cached value with its serial, if not older than the minimum serial like Cache.GetMinSerial.
+// On errors, it returns the zero value of V.
+func (t *TypedCache[K, V]) GetMinSerial(key K, minSerial int64) (V, int64, error) {
+	return t.GetMinSerialContext(context.Background(), key, minSerial)
+}
+
+// GetMinSerialContext is same with GetMinSerial within the context.
+func (t *TypedCache[K, V]) GetMinSerialContext(ctx context.Context, key K, minSerial int64) (V, int64, error) {
+	var val V
+	serial, err := t.cache.GetMinSerialContext(ctx, key, &val, minSerial)
+	if err != nil {
+		var zero V
+		return zero, serial, err
+	}
+	return val, serial, nil
+}
+
+// GetOrLoad returns a cached value with its serial,
+// loading and storing it with the options on misses like Cache.GetOrLoad.
+// If the loader is nil, the Loader of CacheOptions would be used.
+func (t *TypedCache[K, V]) GetOrLoad(key K, loader func(K) (V, error), opts ...SetOption) (V, int64, error) {
+	return t.GetOrLoadContext(context.Background(), key, loader, opts...)
+}
+
+// GetOrLoadContext is same with GetOrLoad within the context.
+func (t *TypedCache[K, V]) GetOrLoadContext(ctx context.Context, key K, loader func(K) (V, error), opts ...SetOption) (V, int64, error) {
+	var load Loader
+	if loader != nil {
+		load = func(interface{}) (interface{}, error) {
+			return loader(key)
+		}
+	}
+	var val V
+	serial, err := t.cache.GetOrLoadContext(ctx, key, &val, load, opts...)
+	if err != nil {
+		var zero V
+		return zero, serial, err
+	}
+	return val, serial, nil
+}
+
+// Set puts a value with a key like Cache.Set.
+func (t *TypedCache[K, V]) Set(key K, val V, opts ...SetOption) (int64, error) {
+	return t.cache.SetContext(context.Background(), key, val, opts...)
+}
+
+// SetContext is same with Set within the context.
+func (t *TypedCache[K, V]) SetContext(ctx context.Context, key K, val V, opts ...SetOption) (int64, error) {
+	return t.cache.SetContext(ctx, key, val, opts...)
+}
+
+// CheckAndSet puts a value with a key like Cache.CheckAndSet.
+func (t *TypedCache[K, V]) CheckAndSet(key K, val V, oserial int64, opts ...SetOption) (int64, error) {
+	return t.cache.CheckAndSetContext(context.Background(), key, val, oserial, opts...)
+}
+
+// CheckAndSetContext is same with CheckAndSet within the context.
+func (t *TypedCache[K, V]) CheckAndSetContext(ctx context.Context, key K, val V, oserial int64, opts ...SetOption) (int64, error) {
+	return t.cache.CheckAndSetContext(ctx, key, val, oserial, opts...)
+}
+
+// SetWithSerial puts a value with a key and the given serial like Cache.SetWithSerial.
+func (t *TypedCache[K, V]) SetWithSerial(key K, val V, serial int64, opts ...SetOption) (int64, error) {
+	return t.cache.SetWithSerialContext(context.Background(), key, val, serial, opts...)
+}
+
+// SetWithSerialContext is same with SetWithSerial within the context.
+func (t *TypedCache[K, V]) SetWithSerialContext(ctx context.Context, key K, val V, serial int64, opts ...SetOption) (int64, error) {
+	return t.cache.SetWithSerialContext(ctx, key, val, serial, opts...)
+}
+
+// CheckAndSetWithSerial puts a value with a key and the given serial like Cache.CheckAndSetWithSerial.
+func (t *TypedCache[K, V]) CheckAndSetWithSerial(key K, val V, oserial int64, nserial int64, opts ...SetOption) (int64, error) {
+	return t.cache.CheckAndSetWithSerialContext(context.Background(), key, val, oserial, nserial, opts...)
+}
+
+// CheckAndSetWithSerialContext is same with CheckAndSetWithSerial within the context.
+func (t *TypedCache[K, V]) CheckAndSetWithSerialContext(ctx context.Context, key K, val V, oserial int64, nserial int64, opts ...SetOption) (int64, error) {
+	return t.cache.CheckAndSetWithSerialContext(ctx, key, val, oserial, nserial, opts...)
+}
+
+// SetNegative puts a tombstone for an absent entity with a key like Cache.SetNegative.
+func (t *TypedCache[K, V]) SetNegative(key K, opts ...SetOption) (int64, error) {
+	return t.cache.SetNegativeContext(context.Background(), key, opts...)
+}
+
+// SetNegativeContext is same with SetNegative within the context.
+func (t *TypedCache[K, V]) SetNegativeContext(ctx context.Context, key K, opts ...SetOption) (int64, error) {
+	return t.cache.SetNegativeContext(ctx, key, opts...)
+}
+
+// Update applies fn to a cached value and stores the result like Cache.Update.
+// fn takes a pointer to the current value, or nil if the key does not exist or it is a tombstone.
+// It returns the stored value with its serial.
+func (t *TypedCache[K, V]) Update(key K, fn func(old *V) (V, error), opts ...SetOption) (V, int64, error) {
+	return t.UpdateContext(context.Background(), key, fn, opts...)
+}
+
+// UpdateContext is same with Update within the context.
+func (t *TypedCache[K, V]) UpdateContext(ctx context.Context, key K, fn func(old *V) (V, error), opts ...SetOption) (V, int64, error) {
+	var cur, nval V
+	serial, err := t.cache.UpdateContext(ctx, key, &cur, func(old interface{}) (interface{}, error) {
+		var err error
+		if old == nil {
+			nval, err = fn(nil)
+		} else {
+			nval, err = fn(&cur)
+		}
+		return nval, err
+	}, opts...)
+	if err != nil {
+		var zero V
+		return zero, 0, err
+	}
+	return nval, serial, nil
+}
+
+// Del removes a cached value for the key.
+func (t *TypedCache[K, V]) Del(key K) error {
+	return t.cache.DelContext(context.Background(), key)
+}
+
+// DelContext is same with Del within the context.
+func (t *TypedCache[K, V]) DelContext(ctx context.Context, key K) error {
+	return t.cache.DelContext(ctx, key)
+}
+
+// MGet returns multiple cached values with their serials like Cache.MGet.
+// Failed keys have zero values, and their errors are in the returned MultiError.
+func (t *TypedCache[K, V]) MGet(keys []K) ([]V, []int64, error) {
+	return t.MGetContext(context.Background(), keys)
+}
+
+// MGetContext is same with MGet within the context.
+func (t *TypedCache[K, V]) MGetContext(ctx context.Context, keys []K) ([]V, []int64, error) {
+	ikeys := make([]interface{}, len(keys))
+	vals := make([]V, len(keys))
+	ptrs := make([]interface{}, len(keys))
+	for i := range keys {
+		ikeys[i] = keys[i]
+		ptrs[i] = &vals[i]
+	}
+
+	serials, err := t.cache.MGetContext(ctx, ikeys, ptrs)
+	if errs, ok := err.(MultiError); ok {
+		for i := range errs {
+			if errs[i] != nil {
+				var zero V
+				vals[i] = zero
+			}
+		}
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return vals, serials, err
+}
+
+// MSet puts multiple values with keys like Cache.MSet.
+func (t *TypedCache[K, V]) MSet(keys []K, vals []V, opts ...SetOption) ([]int64, error) {
+	return t.MSetContext(context.Background(), keys, vals, opts...)
+}
+
+// MSetContext is same with MSet within the context.
+func (t *TypedCache[K, V]) MSetContext(ctx context.Context, keys []K, vals []V, opts ...SetOption) ([]int64, error) {
+	if len(keys) != len(vals) {
+		return nil, ErrMismatch
+	}
+	ikeys := make([]interface{}, len(keys))
+	ivals := make([]interface{}, len(vals))
+	for i := range keys {
+		ikeys[i] = keys[i]
+		ivals[i] = vals[i]
+	}
+	return t.cache.MSetContext(ctx, ikeys, ivals, opts...)
+}
+
+// MDel removes cached values for multiple keys like Cache.MDel.
+func (t *TypedCache[K, V]) MDel(keys []K) error {
+	return t.MDelContext(context.Background(), keys)
+}
+
+// MDelContext is same with MDel within the context.
+func (t *TypedCache[K, V]) MDelContext(ctx context.Context, keys []K) error {
+	ikeys := make([]interface{}, len(keys))
+	for i := range keys {
+		ikeys[i] = keys[i]
+	}
+	return t.cache.MDelContext(ctx, ikeys)
+}
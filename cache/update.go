@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"reflect"
+	"time"
+)
+
+var (
+	ErrConflict = errors.New("Update failed by too many conflicts")
+)
+
+// Returns the number of retries and the base backoff for Update.
+func (c *Cache) updatePolicy() (int, time.Duration) {
+	retries := c.options.UpdateRetries
+	if retries <= 0 {
+		retries = 10
+	}
+	backoff := c.options.UpdateBackoff
+	if backoff <= 0 {
+		backoff = 10 * time.Millisecond
+	}
+	return retries, backoff
+}
+
+// Update applies fn to a cached value and stores the result, in the optimistic manner.
+// It gets the value into val like Get, then puts the value fn returns with CheckAndSet.
+// fn takes val, or nil on misses or for a tombstone.
+// val is reset to its zero value before each Get, so fn would not see leftovers of a conflicted attempt.
+// If another value is stored in the meantime, it retries from Get after a randomized exponential backoff,
+// up to UpdateRetries of CacheOptions, then it fails with ErrConflict.
+// If fn returns an error, Update stops with the error without storing anything.
+// It returns the serial of the stored value.
+func (c *Cache) Update(key interface{}, val interface{}, fn func(old interface{}) (interface{}, error), opts ...SetOption) (int64, error) {
+	return c.UpdateContext(context.Background(), key, val, fn, opts...)
+}
+
+// UpdateContext is same with Update within the context, including the backoff between retries.
+func (c *Cache) UpdateContext(ctx context.Context, key interface{}, val interface{}, fn func(old interface{}) (interface{}, error), opts ...SetOption) (int64, error) {
+	retries, backoff := c.updatePolicy()
+	for i := 0; ; i++ {
+		resetValue(val)
+		old := val
+		oserial, err := c.GetContext(ctx, key, val)
+		var miss *MissError
+		if errors.As(err, &miss) {
+			// A stale or invalidated value is still stored, so check against its serial
+			old, oserial = nil, miss.Serial
+		} else if errors.Is(err, ErrNoKey) || err == ErrNegative {
+			old = nil
+		} else if err != nil {
+			return 0, err
+		}
+
+		nval, err := fn(old)
+		if err != nil {
+			return 0, err
+		}
+		serial, err := c.CheckAndSetContext(ctx, key, nval, oserial, opts...)
+		if err != ErrSetFailed {
+			return serial, err
+		}
+		if i >= retries {
+			return 0, ErrConflict
+		}
+
+		wait := backoff << uint(i)
+		if wait > time.Second || wait <= 0 {
+			wait = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(time.Duration(rand.Int63n(int64(wait))) + 1):
+		}
+	}
+}
+
+// Reset the value which val points to, since unmarshaling merges into maps and keeps absent fields.
+func resetValue(val interface{}) {
+	if rv := reflect.ValueOf(val); rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv.Elem().Set(reflect.Zero(rv.Elem().Type()))
+	}
+}
@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"context"
+	"sync/atomic"
+
+	. "github.com/beatuslapis/gorelib.v0/connector"
+
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// Version is one of the stored versions of a cached value.
+type Version struct {
+	// Serial of the version
+	Serial int64
+
+	bkey []byte
+	data []byte
+	cache *Cache
+}
+
+// Unmarshal deserializes the version into the value, like Get does.
+func (v *Version) Unmarshal(val interface{}) error {
+	return v.cache.unmarshalValue(v.bkey, v.data, val)
+}
+
+// Lua script for getting all the valid versions of a cached value, i.e. written after the validity serial.
+// It returns serials and values, from the newest to the oldest.
+const luaForVersions = luaWrittenFunc + luaCurrentFunc +
+	"local cur=versions(KEYS[1]) " +
+	"local res={} " +
+	"for i=1, #cur, 2 do " +
+	"  if written(cur[i], cur[i+1]) > tonumber(ARGV[1]) then " +
+	"    res[#res+1]=cur[i] " +
+	"    res[#res+1]=math.floor(cur[i+1]) " +
+	"  end " +
+	"end " +
+	"return res "
+
+// GetVersions returns all the stored versions of a cached value, from the newest to the oldest.
+// How many versions are kept depends on HistoryDepth and MaxVersionAge of CacheOptions.
+// Versions not written after the validity serial of the connector are excluded, like Get.
+// Note that identical values share a version, which holds the latest serial of them.
+func (c *Cache) GetVersions(key interface{}) ([]Version, error) {
+	return c.GetVersionsContext(context.Background(), key)
+}
+
+// GetVersionsContext is same with GetVersions within the context.
+func (c *Cache) GetVersionsContext(ctx context.Context, key interface{}) ([]Version, error) {
+	bkey, err := c.marshalKey(key)
+	if err != nil {
+		return nil, err
+	}
+	client, disconnect, validSince, err := c.connect(ctx, bkey)
+	if err != nil {
+		return nil, err
+	}
+	defer func(){ if disconnect != nil { disconnect() } }()
+
+	res, err := luaEval(ctx, client, luaForVersions, 1, bkey, validSince).Array()
+	if err != nil {
+		return nil, err
+	}
+	if len(res) % 2 != 0 {
+		return nil, ErrRESPParse
+	}
+	if len(res) == 0 {
+		return nil, ErrNoKey
+	}
+
+	versions := make([]Version, 0, len(res) / 2)
+	for i := 0; i < len(res); i += 2 {
+		bval, err := res[i].Bytes()
+		if err != nil {
+			return nil, ErrRESPParse
+		}
+		serial, err := res[i+1].Int64()
+		if err != nil {
+			return nil, ErrRESPParse
+		}
+		versions = append(versions, Version{
+			Serial: serial,
+			bkey: bkey,
+			data: bval,
+			cache: c,
+		})
+	}
+	return versions, nil
+}
+
+// Lua script for getting a specific version of a cached value, if written after the validity serial.
+const luaForGetAt = luaWrittenFunc + luaCurrentFunc +
+	"local cur=version(KEYS[1], ARGV[1]) " +
+	"if cur and written(cur, ARGV[1]) > tonumber(ARGV[2]) then " +
+	"  return cur " +
+	"end " +
+	"return false "
+
+// GetAt returns a specific version of a cached value with the serial.
+// If no such version exists, or it is not written after the validity serial, GetAt returns ErrNoKey.
+func (c *Cache) GetAt(key interface{}, serial int64, val interface{}) error {
+	return c.GetAtContext(context.Background(), key, serial, val)
+}
+
+// GetAtContext is same with GetAt within the context.
+func (c *Cache) GetAtContext(ctx context.Context, key interface{}, serial int64, val interface{}) error {
+	bkey, err := c.marshalKey(key)
+	if err != nil {
+		return err
+	}
+	client, disconnect, validSince, err := c.connect(ctx, bkey)
+	if err != nil {
+		return err
+	}
+	defer func(){ if disconnect != nil { disconnect() } }()
+
+	resp := luaEval(ctx, client, luaForGetAt, 1, bkey, serial, validSince)
+	if resp.Err != nil {
+		return resp.Err
+	}
+	if resp.IsType(redis.Nil) {
+		return ErrNoKey
+	}
+	bval, err := resp.Bytes()
+	if err != nil {
+		return ErrRESPParse
+	}
+	return c.unmarshalValue(bkey, bval, val)
+}
+
+// Lua script for reverting a cached value to one of its versions.
+// The version would be the most recent one again with a new serial, in the manner of the set function.
+// Its tags, if any, are kept as they were, so a version invalidated by tags stays invalidated.
+// A recorded time of writing is dropped, since the new serial is the time.
+const luaForRevert = luaSetFunc + luaWrittenFunc + luaUnwrittenFunc +
+	"local cur=version(KEYS[1], ARGV[1]) " +
+	"if not cur or written(cur, ARGV[1]) <= tonumber(ARGV[7]) then " +
+	"  return 0 " +
+	"end " +
+	"return set(KEYS[1], unwritten(cur), ARGV[2], ARGV[3], ARGV[4], ARGV[5], ARGV[6], '') "
+
+// Revert makes an older version of a cached value, with the serial, current again.
+// The reverted value gets a new serial which Revert returns.
+// If no such version exists, or it is not written after the validity serial, Revert returns ErrNoKey.
+// If a value of newer serial already exists, Revert would fail with ErrSetFailed.
+// If the key is replicated, the primary replica decides, then the others revert the version they have.
+// Replicas without the version would keep older values until repaired by reads.
+func (c *Cache) Revert(key interface{}, serial int64, opts ...SetOption) (int64, error) {
+	return c.RevertContext(context.Background(), key, serial, opts...)
+}
+
+// RevertContext is same with Revert within the context.
+func (c *Cache) RevertContext(ctx context.Context, key interface{}, serial int64, opts ...SetOption) (int64, error) {
+	bkey, err := c.marshalKey(key)
+	if err != nil {
+		return 0, err
+	}
+	mode, ms, err := c.expiration(opts)
+	if err != nil {
+		return 0, err
+	}
+	conns := c.connectReplicas(WithWrite(ctx), bkey)
+	defer disconnectAll(conns)
+	primary := firstConnected(conns)
+	if primary == nil {
+		return 0, conns[0].Err
+	}
+
+	nserial, err := c.serial(ctx, primary.Client, nil)
+	if err != nil {
+		return 0, err
+	}
+	depth, floor := c.retention(nserial)
+	err = replicate(conns, primary, func(conn *Conn) error {
+		resp := luaEval(ctx, conn.Client, luaForRevert, 1, bkey, serial, nserial, mode, ms, depth, floor, conn.ValidSince)
+		if resp.Err != nil {
+			return resp.Err
+		}
+		if resp.IsType(redis.Nil) {
+			return ErrSetFailed
+		}
+		if n, err := resp.Int(); err != nil || n != 1 {
+			return ErrNoKey
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	atomic.AddInt64(&c.loads, 1)
+	c.notify(ctx, [][]byte{bkey}, []int64{nserial})
+	return nserial, nil
+}
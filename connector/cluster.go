@@ -1,7 +1,9 @@
 package connector
 
 import (
+	"context"
 	"errors"
+	"sort"
 	"sync"
 	"time"
 
@@ -19,6 +21,20 @@ type ClusterOptions struct {
 	Checker HealthChecker
 	Poolsize int
 	Failover bool
+
+	// Number of distinct shards which a key is replicated to, 1 if not set.
+	// Replicas of a key are the first shards following the hash ring from the key,
+	// excluding ones not alive. With Failover, following shards would take their places.
+	Replicas int
+
+	// Record hints on shards taking over keys by failover, and drop their copies
+	// when the owner shards are back alive. Otherwise, the copies are left until expired.
+	// Hints are recorded only for writes, i.e. connections within a context marked by WithWrite.
+	Handoff bool
+
+	// Expiration time of hint sets, a day if not set.
+	// Hints for owners not back within it would be dropped, leaving their copies until expired.
+	HandoffExpiration time.Duration
 }
 
 // A connector with clustered redis instances.
@@ -35,6 +51,9 @@ type Cluster struct {
 	status map[string]ShardStatus
 
 	failover bool
+	replicas int
+	handoff bool
+	handoffExpiration time.Duration
 }
 
 // Error definitions
@@ -70,6 +89,17 @@ func NewCluster(options *ClusterOptions) (*Cluster, error) {
 	c.ring = ring
 	c.pool = make(map[*Shard]*pool.Pool, len(c.shards))
 	c.failover = options.Failover
+	c.handoff = options.Handoff
+	if options.HandoffExpiration > 0 {
+		c.handoffExpiration = options.HandoffExpiration
+	} else {
+		c.handoffExpiration = 24 * time.Hour
+	}
+	if options.Replicas > 1 {
+		c.replicas = options.Replicas
+	} else {
+		c.replicas = 1
+	}
 
 	c.checker = options.Checker
 	c.status = make(map[string]ShardStatus, len(c.shards))
@@ -83,8 +113,13 @@ func NewCluster(options *ClusterOptions) (*Cluster, error) {
 func (c *Cluster) statusUpdateReceiver(updates <-chan ShardStatus) {
 	for update := range updates {
 		c.mx.Lock()
+		prev, known := c.status[update.Addr]
 		c.status[update.Addr] = update
 		c.mx.Unlock()
+
+		if c.handoff && known && !prev.Alive && update.Alive {
+			go c.reconcile(update.Addr)
+		}
 	}
 }
 
@@ -122,32 +157,281 @@ func (c *Cluster) getShard(key []byte) (*Shard, int64, error) {
 // If a located shard is not ready yet, i.e. the health checker does not decide its status,
 // wait 0.1 second for settling down.
 func (c *Cluster) Connect(key []byte) (*redis.Client, func(), int64, error) {
+	return c.ConnectContext(context.Background(), key)
+}
+
+// Same with Connect, but it stops waiting for a settling shard
+// or checking out a pooled client as soon as the context is done.
+func (c *Cluster) ConnectContext(ctx context.Context, key []byte) (*redis.Client, func(), int64, error) {
+	shard, since, err := c.locate(ctx, key)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	client, disconnect, since, err := c.connectShard(ctx, shard, since)
+	if err == nil {
+		if owners := c.handoffOwners(ctx, key, shard); len(owners) > 0 {
+			c.hint(ctx, client, owners, key)
+		}
+	}
+	return client, disconnect, since, err
+}
+
+// Locate and connect to redis instances with multiple keys.
+// Keys on the same shard, including failovers, share a connection.
+func (c *Cluster) ConnectBatch(ctx context.Context, keys [][]byte) []Conn {
+	conns := make([]Conn, 0)
+	byShard := make(map[*Shard]int)
+	byError := make(map[error]int)
+	handoffs := make(map[*Shard]map[*Shard][][]byte)
+	for i, key := range keys {
+		shard, since, err := c.locate(ctx, key)
+		if err == nil {
+			for _, owner := range c.handoffOwners(ctx, key, shard) {
+				if handoffs[shard] == nil {
+					handoffs[shard] = make(map[*Shard][][]byte)
+				}
+				handoffs[shard][owner] = append(handoffs[shard][owner], key)
+			}
+		}
+		if err != nil {
+			if idx, ok := byError[err]; ok {
+				conns[idx].Keys = append(conns[idx].Keys, i)
+			} else {
+				byError[err] = len(conns)
+				conns = append(conns, Conn{Keys: []int{i}, Err: err})
+			}
+		} else if idx, ok := byShard[shard]; ok {
+			conns[idx].Keys = append(conns[idx].Keys, i)
+		} else {
+			byShard[shard] = len(conns)
+			conns = append(conns, Conn{Keys: []int{i}, ValidSince: since})
+		}
+	}
+
+	for shard, idx := range byShard {
+		conns[idx].Client, conns[idx].Disconnect, _, conns[idx].Err = c.connectShard(ctx, shard, conns[idx].ValidSince)
+		if conns[idx].Err == nil {
+			for owner, hkeys := range handoffs[shard] {
+				c.hint(ctx, conns[idx].Client, []*Shard{owner}, hkeys...)
+			}
+		}
+	}
+	return conns
+}
+
+// Connect to every alive shard of the cluster.
+// Shards not alive are skipped, since they would get a new validity serial when they are back.
+// If a shard is not ready yet, wait for settling down within the context like Connect.
+func (c *Cluster) ConnectAll(ctx context.Context) []Conn {
+	shards, sinces, err := c.waitAlive(ctx)
+	if err != nil {
+		return []Conn{{Err: err}}
+	}
+
+	conns := make([]Conn, len(shards))
+	for i, shard := range shards {
+		conns[i].ValidSince = sinces[i]
+		conns[i].Client, conns[i].Disconnect, _, conns[i].Err = c.connectShard(ctx, shard, sinces[i])
+	}
+	return conns
+}
+
+// Returns the addresses of every alive shard of the cluster, in sorted order.
+func (c *Cluster) Addrs(ctx context.Context) ([]string, error) {
+	shards, _, err := c.waitAlive(ctx)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(shards))
+	for i, shard := range shards {
+		addrs[i] = shard.Addr
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+// Connect to the alive shard of the address.
+func (c *Cluster) ConnectAddr(ctx context.Context, addr string) Conn {
+	shards, sinces, err := c.waitAlive(ctx)
+	if err != nil {
+		return Conn{Err: err}
+	}
+	for i, shard := range shards {
+		if shard.Addr == addr {
+			conn := Conn{ValidSince: sinces[i]}
+			conn.Client, conn.Disconnect, _, conn.Err = c.connectShard(ctx, shard, sinces[i])
+			return conn
+		}
+	}
+	return Conn{Err: ErrUnknownAddr}
+}
+
+// Get all the alive shards with their validity serials.
+// If a shard is not ready yet, wait for settling down within the context like Connect.
+func (c *Cluster) waitAlive(ctx context.Context) ([]*Shard, []int64, error) {
+	shards, sinces, err := c.aliveShards()
+	for i := 0; err == ErrNotReady && i < 10; i++ {
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+		shards, sinces, err = c.aliveShards()
+	}
+	return shards, sinces, err
+}
+
+// Get all the alive shards with their validity serials.
+func (c *Cluster) aliveShards() ([]*Shard, []int64, error) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+
+	if c.ring == nil {
+		return nil, nil, ErrNotAvail
+	}
+
+	shards := make([]*Shard, 0, len(c.shards))
+	sinces := make([]int64, 0, len(c.shards))
+	for i := range c.shards {
+		status, ok := c.status[c.shards[i].Addr]
+		if !ok {
+			return nil, nil, ErrNotReady
+		}
+		if status.Alive {
+			shards = append(shards, &c.shards[i])
+			sinces = append(sinces, status.Since)
+		}
+	}
+	return shards, sinces, nil
+}
+
+// Connect to the replica shards of the key, in the order of the hash ring.
+// Shards not alive are skipped, and the next ones on the ring would take their places if failover is enabled.
+func (c *Cluster) ConnectReplicas(ctx context.Context, key []byte) []Conn {
+	shards, sinces, err := c.getReplicas(key)
+	for i := 0; err == ErrNotReady && i < 10; i++ {
+		select {
+		case <-ctx.Done():
+			return []Conn{{Err: ctx.Err()}}
+		case <-time.After(100 * time.Millisecond):
+		}
+		shards, sinces, err = c.getReplicas(key)
+	}
+	if err != nil {
+		return []Conn{{Err: err}}
+	}
+
+	var owners, skipped []*Shard
+	if c.handoff && IsWrite(ctx) {
+		owners = c.ringShards(key, c.replicas)
+		for _, owner := range owners {
+			if indexOf(shards, owner) < 0 {
+				skipped = append(skipped, owner)
+			}
+		}
+	}
+
+	conns := make([]Conn, len(shards))
+	for i, shard := range shards {
+		conns[i].ValidSince = sinces[i]
+		conns[i].Client, conns[i].Disconnect, _, conns[i].Err = c.connectShard(ctx, shard, sinces[i])
+		if conns[i].Err == nil && len(skipped) > 0 && indexOf(owners, shard) < 0 {
+			c.hint(ctx, conns[i].Client, skipped, key)
+		}
+	}
+	return conns
+}
+
+// Returns the number of shards which a key is replicated to.
+func (c *Cluster) Replicas() int {
+	return c.replicas
+}
+
+// Get the alive replica shards of the key with their validity serials.
+func (c *Cluster) getReplicas(key []byte) ([]*Shard, []int64, error) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+
+	if c.ring == nil {
+		return nil, nil, ErrNotAvail
+	}
+
+	shards := make([]*Shard, 0, c.replicas)
+	sinces := make([]int64, 0, c.replicas)
+	seen := make(map[*Shard]bool, c.replicas)
+	shard, next := c.ring.Get(key)
+	for ; shard != nil && len(shards) < c.replicas; shard = next() {
+		if seen[shard] {
+			continue
+		}
+		if !c.failover && len(seen) >= c.replicas {
+			break
+		}
+		seen[shard] = true
+		if status, ok := c.status[shard.Addr]; !ok {
+			return nil, nil, ErrNotReady
+		} else if status.Alive {
+			shards = append(shards, shard)
+			sinces = append(sinces, status.Since)
+		}
+	}
+	if len(shards) == 0 {
+		return nil, nil, ErrNotAvail
+	}
+	return shards, sinces, nil
+}
+
+// Locate a shard for the key.
+// If a located shard is not ready yet, wait for settling down within the context.
+func (c *Cluster) locate(ctx context.Context, key []byte) (*Shard, int64, error) {
 	shard, since, err := c.getShard(key)
 	if err == ErrNotReady {
 		for i := 0; err == ErrNotReady && i < 10; i++ {
-			time.Sleep(100 * time.Millisecond)
+			select {
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			case <-time.After(100 * time.Millisecond):
+			}
 			shard, since, err = c.getShard(key)
 		}
 	}
+	return shard, since, err
+}
+
+// Connect to the shard, checking out a client from its pool.
+func (c *Cluster) connectShard(ctx context.Context, shard *Shard, since int64) (*redis.Client, func(), int64, error) {
+	cp, err := c.getPool(shard)
 	if err != nil {
 		return nil, nil, 0, err
 	}
 
+	if client, err := checkout(ctx, cp); err == nil {
+		return client, func(){ cp.Put(client) }, since, nil
+	} else {
+		return nil, nil, 0, err
+	}
+}
+
+// Get a connection pool for the shard, creating one if needed.
+func (c *Cluster) getPool(shard *Shard) (*pool.Pool, error) {
+	c.mx.RLock()
 	cp := c.pool[shard]
-	if cp == nil {
+	c.mx.RUnlock()
+	if cp != nil {
+		return cp, nil
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if cp = c.pool[shard]; cp == nil {
 		if np, err := pool.New("tcp", shard.Addr, c.poolsize); err != nil {
-			return nil, nil, 0, err
+			return nil, err
 		} else {
 			c.pool[shard] = np
 			cp = np
 		}
 	}
-
-	if client, err := cp.Get(); err == nil {
-		return client, func(){ cp.Put(client) }, since, nil
-	} else {
-		return nil, nil, 0, err
-	}
+	return cp, nil
 }
 
 // Dispose the connector
@@ -167,4 +451,141 @@ func (c *Cluster) Shutdown() {
 	c.shards = nil
 	c.ring = nil
 	c.checker = nil
-}
\ No newline at end of file
+}
+
+// Prefix of the redis keys for hints, followed by the name of the owner shard.
+// A hint set on a shard holds keys which the shard took over from the owner by failover.
+const hintPrefix = "gorelib:hints:"
+
+// Returns the first n distinct shards on the hash ring from the key, regardless of their status.
+func (c *Cluster) ringShards(key []byte, n int) []*Shard {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+
+	if c.ring == nil {
+		return nil
+	}
+	shards := make([]*Shard, 0, n)
+	shard, next := c.ring.Get(key)
+	for ; shard != nil && len(shards) < n; shard = next() {
+		if indexOf(shards, shard) < 0 {
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
+// Returns the owners of the key which the shard took over from, for a write with handoff enabled.
+// A shard taking over the key is not one of its replicas, so all of them should be skipped for not alive.
+func (c *Cluster) handoffOwners(ctx context.Context, key []byte, shard *Shard) []*Shard {
+	if !c.handoff || !IsWrite(ctx) {
+		return nil
+	}
+	owners := c.ringShards(key, c.replicas)
+	if indexOf(owners, shard) >= 0 {
+		return nil
+	}
+	return owners
+}
+
+func indexOf(shards []*Shard, shard *Shard) int {
+	for i := range shards {
+		if shards[i] == shard {
+			return i
+		}
+	}
+	return -1
+}
+
+// Record hints for the keys taken over from the owners on the client, refreshing expirations of hint sets.
+// Failures are ignored, then the copies would be left until expired.
+func (c *Cluster) hint(ctx context.Context, client *redis.Client, owners []*Shard, keys ...[]byte) {
+	args := make([]interface{}, len(keys) + 1)
+	for i := range keys {
+		args[i + 1] = keys[i]
+	}
+	ms := int64(c.handoffExpiration / time.Millisecond)
+	Roundtrip(ctx, client, func() *redis.Resp {
+		for _, owner := range owners {
+			args[0] = hintPrefix + owner.Name
+			client.PipeAppend("SADD", args...)
+			client.PipeAppend("PEXPIRE", args[0], ms)
+		}
+		var resp *redis.Resp
+		for i := 0; i < 2 * len(owners); i++ {
+			if r := client.PipeResp(); r.Err != nil && resp == nil {
+				resp = r
+			}
+		}
+		if resp == nil {
+			resp = redis.NewResp(nil)
+		}
+		return resp
+	})
+}
+
+// Drop copies of keys taken over from the shard back alive, on the other alive shards.
+// Copies of keys which the shard no longer owns are kept, while their hints are removed.
+// Copies written by processes not noticed the shard back yet might be left until expired.
+func (c *Cluster) reconcile(addr string) {
+	var owner *Shard
+	c.mx.RLock()
+	for i := range c.shards {
+		if c.shards[i].Addr == addr {
+			owner = &c.shards[i]
+		}
+	}
+	c.mx.RUnlock()
+	if owner == nil {
+		return
+	}
+
+	shards, _, err := c.aliveShards()
+	if err != nil {
+		return
+	}
+	conns := c.ConnectAll(context.Background())
+	for i := range conns {
+		if conns[i].Err != nil {
+			continue
+		}
+		if conns[i].Client.Addr != addr {
+			for _, shard := range shards {
+				if shard.Addr == conns[i].Client.Addr {
+					c.dropHandoffs(conns[i].Client, shard, owner)
+				}
+			}
+		}
+		conns[i].Disconnect()
+	}
+}
+
+// Drop copies of keys taken over from the owner on the client of the shard, scanning its hint set.
+// A copy is kept if the shard is one of the replicas of the key, or the owner no longer is.
+func (c *Cluster) dropHandoffs(client *redis.Client, shard *Shard, owner *Shard) {
+	hkey := hintPrefix + owner.Name
+	cursor := "0"
+	for {
+		res, err := client.Cmd("SSCAN", hkey, cursor, "COUNT", 100).Array()
+		if err != nil || len(res) != 2 {
+			return
+		}
+		cursor, err = res[0].Str()
+		if err != nil {
+			return
+		}
+		keys, err := res[1].ListBytes()
+		if err != nil {
+			return
+		}
+		for _, key := range keys {
+			if owners := c.ringShards(key, c.replicas); indexOf(owners, owner) >= 0 && indexOf(owners, shard) < 0 {
+				client.Cmd("DEL", key)
+			}
+			client.Cmd("SREM", hkey, key)
+		}
+		if cursor == "0" {
+			return
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package connector
 
 import (
+	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	. "github.com/beatuslapis/gorelib.v0/checker"
 	. "github.com/beatuslapis/gorelib.v0/connector/cluster"
+
+	"github.com/mediocregopher/radix.v2/redis"
 )
 
 type readncheck struct {
@@ -84,4 +88,255 @@ func TestFailover(t *testing.T) {
 	resp := client.Cmd("PING")
 	fmt.Println(serial, resp)
 	disconnect()
-}
\ No newline at end of file
+}
+
+func TestReplicas(t *testing.T) {
+	testNodes := make(map[string]string)
+	testNodes["serverA"] = ":6378"
+	testNodes["serverB"] = ":6379"
+	testNodes["serverC"] = ":6377"
+
+	for _, failover := range []bool{true, false} {
+		readerAndChecker := &readncheck{
+			nodes: testNodes,
+		}
+		cluster, err := NewCluster(&ClusterOptions{
+			Reader: readerAndChecker,
+			Builder: &ConsistentRing{
+				Nreplica: 3,
+			},
+			Checker: readerAndChecker,
+			Failover: failover,
+			Replicas: 2,
+		})
+		if err != nil {
+			t.Fatal("can't create a cluster:", err)
+		}
+
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("test%d", i))
+			shards, _, err := cluster.getReplicas(key)
+			for j := 0; err == ErrNotReady && j < 10; j++ {
+				time.Sleep(100 * time.Millisecond)
+				shards, _, err = cluster.getReplicas(key)
+			}
+			if err != nil {
+				t.Fatal("can't get replicas:", err)
+			}
+			if failover && len(shards) != 2 || !failover && len(shards) == 0 || len(shards) > 2 {
+				fmt.Println("incorrect number of replicas:", failover, len(shards))
+				t.Fail()
+			}
+			if len(shards) == 2 && shards[0] == shards[1] {
+				fmt.Println("replicas are not distinct:", shards[0].Name)
+				t.Fail()
+			}
+			for _, shard := range shards {
+				if shard.Addr == ":6378" {
+					fmt.Println("dead shard is a replica")
+					t.Fail()
+				}
+			}
+		}
+		cluster.Shutdown()
+	}
+}
+
+func TestHandoffOwners(t *testing.T) {
+	testNodes := make(map[string]string)
+	testNodes["serverA"] = ":6378"
+	testNodes["serverB"] = ":6379"
+
+	readerAndChecker := &readncheck{
+		nodes: testNodes,
+	}
+	cluster, err := NewCluster(&ClusterOptions{
+		Reader: readerAndChecker,
+		Builder: &ConsistentRing{
+			Nreplica: 3,
+		},
+		Checker: readerAndChecker,
+		Failover: true,
+		Handoff: true,
+	})
+	if err != nil {
+		t.Fatal("can't create a cluster:", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("test%d", i))
+		shard, _, err := cluster.locate(context.Background(), key)
+		if err != nil {
+			t.Fatal("can't locate a shard:", err)
+		}
+		owners := cluster.ringShards(key, 2)
+		if len(owners) != 2 || owners[0] == owners[1] {
+			fmt.Println("incorrect owners:", owners)
+			t.Fail()
+			continue
+		}
+		if owners[0].Addr == ":6378" && shard != owners[1] || owners[0].Addr != ":6378" && shard != owners[0] {
+			fmt.Println("unexpected shard for the owners:", shard.Name, owners[0].Name)
+			t.Fail()
+		}
+	}
+	cluster.Shutdown()
+}
+
+// A checker which starts with some shards dead, and revives them on demand
+type revivecheck struct {
+	dead map[string]bool
+	updates chan ShardStatus
+}
+
+func (r *revivecheck) Start(shards []Shard) <-chan ShardStatus {
+	r.updates = make(chan ShardStatus)
+
+	go func() {
+		for _, s := range shards {
+			r.updates <- ShardStatus{
+				Addr: s.Addr,
+				Alive: !r.dead[s.Addr],
+			}
+		}
+	}()
+
+	return r.updates
+}
+
+func (r *revivecheck) revive(addr string) {
+	r.updates <- ShardStatus{
+		Addr: addr,
+		Alive: true,
+		Since: time.Now().UnixNano() / 1000,
+	}
+}
+
+func (r *revivecheck) Stop() {
+	close(r.updates)
+	return
+}
+
+func TestHandoffReconcile(t *testing.T) {
+	// All the shards are the same redis instance under different addresses,
+	// so the copies of a key and the hint sets are shared by them.
+	testNodes := make(map[string]string)
+	testNodes["serverA"] = "127.0.0.1:6379"
+	testNodes["serverB"] = "0.0.0.0:6379"
+	testNodes["serverC"] = ":6379"
+
+	checker := &revivecheck{
+		dead: map[string]bool{"127.0.0.1:6379": true},
+	}
+	cluster, err := NewCluster(&ClusterOptions{
+		Reader: &readncheck{nodes: testNodes},
+		Builder: &ConsistentRing{
+			Nreplica: 3,
+		},
+		Checker: checker,
+		Failover: true,
+		Replicas: 2,
+		Handoff: true,
+	})
+	if err != nil {
+		t.Fatal("can't create a cluster:", err)
+	}
+	defer cluster.Shutdown()
+
+	client, err := redis.Dial("tcp", ":6379")
+	if err != nil {
+		t.Fatal("can't connect to redis:", err)
+	}
+	defer client.Close()
+
+	shards := make(map[string]*Shard)
+	for i := range cluster.shards {
+		shards[cluster.shards[i].Name] = &cluster.shards[i]
+	}
+
+	// Keys owned by the dead shard A, one kept on the other owner and one taken over by C
+	var kept, taken []byte
+	for i := 0; kept == nil || taken == nil; i++ {
+		key := []byte(fmt.Sprintf("handoffTest%d", i))
+		if owners := cluster.ringShards(key, 2); owners[0].Name == "serverA" {
+			if kept == nil {
+				kept = key
+			} else {
+				taken = key
+			}
+		}
+	}
+	hkey := hintPrefix + "serverA"
+	client.Cmd("DEL", hkey, kept, taken)
+	ctx := WithWrite(context.Background())
+
+	conn, disconnect, _, err := cluster.ConnectContext(ctx, kept)
+	if err != nil {
+		t.Fatal("can't connect to a shard:", err)
+	}
+	conn.Cmd("SET", kept, "kept")
+	disconnect()
+
+	conns := cluster.ConnectReplicas(ctx, taken)
+	if len(conns) != 2 {
+		t.Fatal("incorrect number of replicas:", len(conns))
+	}
+	for i := range conns {
+		if conns[i].Err != nil {
+			t.Fatal("can't connect to a replica:", conns[i].Err)
+		}
+		conns[i].Client.Cmd("SET", taken, "taken")
+		conns[i].Disconnect()
+	}
+
+	if n, _ := client.Cmd("SISMEMBER", hkey, kept).Int(); n != 0 {
+		fmt.Println("hint is recorded for a replica owner")
+		t.Fail()
+	}
+	if n, _ := client.Cmd("SISMEMBER", hkey, taken).Int(); n != 1 {
+		fmt.Println("hint is not recorded for a key taken over")
+		t.Fail()
+	}
+	if ttl, _ := client.Cmd("PTTL", hkey).Int64(); ttl <= 0 {
+		fmt.Println("hint set has no expiration:", ttl)
+		t.Fail()
+	}
+
+	checker.revive("127.0.0.1:6379")
+	for i := 0; i < 20; i++ {
+		if n, _ := client.Cmd("SCARD", hkey).Int(); n == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n, _ := client.Cmd("SCARD", hkey).Int(); n != 0 {
+		fmt.Println("hints are not reconciled:", n)
+		t.Fail()
+	}
+	if n, _ := client.Cmd("EXISTS", kept).Int(); n != 1 {
+		fmt.Println("copy on a replica owner is dropped")
+		t.Fail()
+	}
+
+	// Copies are dropped only on shards which are not replicas of their keys
+	client.Cmd("SADD", hkey, kept)
+	cluster.dropHandoffs(client, cluster.ringShards(kept, 2)[1], shards["serverA"])
+	if n, _ := client.Cmd("EXISTS", kept).Int(); n != 1 {
+		fmt.Println("copy on a replica owner is dropped")
+		t.Fail()
+	}
+	client.Cmd("SET", taken, "taken")
+	owners := cluster.ringShards(taken, 2)
+	for _, shard := range shards {
+		if indexOf(owners, shard) < 0 {
+			client.Cmd("SADD", hkey, taken)
+			cluster.dropHandoffs(client, shard, shards["serverA"])
+		}
+	}
+	if n, _ := client.Cmd("EXISTS", taken).Int(); n != 0 {
+		fmt.Println("copy taken over is not dropped")
+		t.Fail()
+	}
+
+	client.Cmd("DEL", hkey, kept, taken)
+}
@@ -1,9 +1,17 @@
 package connector
 
 import (
+	"context"
+	"errors"
+
+	"github.com/mediocregopher/radix.v2/pool"
 	"github.com/mediocregopher/radix.v2/redis"
 )
 
+var (
+	ErrUnknownAddr = errors.New("No redis instance for the address.")
+)
+
 // Connector inteface to get a redis client
 type Connector interface {
 	// Connect takes a key of []byte form.
@@ -15,3 +23,144 @@ type Connector interface {
 	// Dispose the connector
 	Shutdown()
 }
+
+// ContextConnector is a Connector which honors deadlines and cancellations of a context.
+type ContextConnector interface {
+	Connector
+
+	// ConnectContext is same with Connect,
+	// except that it gives up with ctx.Err() when the context is done before a client is ready.
+	ConnectContext(context.Context, []byte) (*redis.Client, func(), int64, error)
+}
+
+// A connection to a redis instance for a batch of keys.
+type Conn struct {
+	Client *redis.Client
+	Disconnect func()
+
+	// Validity serial of the redis instance, same with the one Connect returns
+	ValidSince int64
+
+	// Indices of the keys located on the redis instance
+	Keys []int
+
+	// The error on locating or connecting to the redis instance.
+	// If set, the Client would be nil.
+	Err error
+}
+
+// BatchConnector is a ContextConnector which could locate multiple keys at once.
+type BatchConnector interface {
+	ContextConnector
+
+	// ConnectBatch groups keys by the redis instances they are located on,
+	// and connects to each instance once.
+	// Every key would be in exactly one Conn, either connected or failed.
+	ConnectBatch(context.Context, [][]byte) []Conn
+}
+
+// BroadcastConnector is a ContextConnector which could connect to all of its redis instances.
+type BroadcastConnector interface {
+	ContextConnector
+
+	// ConnectAll connects to every redis instance which keys could be located on.
+	// Instances not alive could be skipped, since their keys would be invalidated by the validity serial.
+	// Conns from ConnectAll have no Keys.
+	ConnectAll(context.Context) []Conn
+
+	// Addrs returns the addresses of the redis instances which ConnectAll would connect to, in sorted order.
+	Addrs(context.Context) ([]string, error)
+
+	// ConnectAddr connects to one of the redis instances by its address from Addrs.
+	// The Conn from ConnectAddr has no Keys.
+	ConnectAddr(context.Context, string) Conn
+}
+
+// ReplicaConnector is a ContextConnector which could replicate a key to multiple redis instances.
+type ReplicaConnector interface {
+	ContextConnector
+
+	// ConnectReplicas connects to the redis instances which the key is replicated to,
+	// in the order of their priorities. The first one is regarded as the primary.
+	// Conns from ConnectReplicas have no Keys.
+	ConnectReplicas(context.Context, []byte) []Conn
+
+	// Replicas returns the number of redis instances which a key is replicated to.
+	Replicas() int
+}
+
+// Key of the context value marking connections for writes
+type writeKey struct{}
+
+// WithWrite returns a context marking connections made within it as for writes.
+// Connectors could track where keys are written with it, like hints of the Cluster.
+func WithWrite(ctx context.Context) context.Context {
+	return context.WithValue(ctx, writeKey{}, true)
+}
+
+// IsWrite reports whether the context is marked by WithWrite.
+func IsWrite(ctx context.Context) bool {
+	write, _ := ctx.Value(writeKey{}).(bool)
+	return write
+}
+
+// Check out a client from the pool within the context.
+// The pool could dial a new connection when it has no idle one.
+// If the context is done while dialing, the client would be put back when it arrives.
+func checkout(ctx context.Context, p *pool.Pool) (*redis.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctx.Done() == nil {
+		return p.Get()
+	}
+
+	type result struct {
+		client *redis.Client
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		client, err := p.Get()
+		done <- result{client, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.client, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.err == nil {
+				p.Put(r.client)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Roundtrip performs a round trip with the client within the context.
+// If the context is done before the reply, the client would be closed to abort the round trip.
+// The closed client is marked with its LastCritical error, so the pool would discard it rather than reuse.
+func Roundtrip(ctx context.Context, client *redis.Client, fn func() *redis.Resp) *redis.Resp {
+	if ctx.Done() == nil {
+		return fn()
+	}
+	if err := ctx.Err(); err != nil {
+		return redis.NewResp(err)
+	}
+
+	done := make(chan *redis.Resp, 1)
+	go func() { done <- fn() }()
+
+	select {
+	case resp := <-done:
+		return resp
+	case <-ctx.Done():
+		client.Close()
+		<-done
+		if client.LastCritical == nil {
+			client.LastCritical = ctx.Err()
+		}
+		return redis.NewResp(ctx.Err())
+	}
+}
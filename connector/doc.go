@@ -9,6 +9,11 @@
 // It uses the HashRing to distribute and locate data with keys.
 // To build the HashRing, it requires NodeReader for cluster topologies,
 // and RingBuilder to specify shard and failover strategies.
+// Keys could be replicated to multiple shards on the HashRing,
+// and copies taken over by failover could be dropped by hinted handoff when owners are back.
+//
+// Both implementations are also ContextConnectors,
+// so deadlines and cancellations of a context could be applied while connecting.
+// They could also connect to all of their instances, and to the replicas of a key.
 //
-/
 package connector
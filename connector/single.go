@@ -1,6 +1,8 @@
 package connector
 
 import (
+	"context"
+
 	"github.com/mediocregopher/radix.v2/pool"
 	"github.com/mediocregopher/radix.v2/redis"
 )
@@ -30,6 +32,59 @@ func (c *Single) Connect(key []byte) (*redis.Client, func (), int64, error) {
 	}
 }
 
+// Connect to a pooled single redis instance within the context
+func (c *Single) ConnectContext(ctx context.Context, key []byte) (*redis.Client, func(), int64, error) {
+	if client, err := checkout(ctx, c.pool); err != nil {
+		return nil, nil, 0, err
+	} else {
+		return client, func() { c.pool.Put(client) }, 0, nil
+	}
+}
+
+// Connect to a pooled single redis instance for all the keys
+func (c *Single) ConnectBatch(ctx context.Context, keys [][]byte) []Conn {
+	conn := Conn{
+		Keys: make([]int, len(keys)),
+	}
+	for i := range keys {
+		conn.Keys[i] = i
+	}
+	conn.Client, conn.Disconnect, _, conn.Err = c.ConnectContext(ctx, nil)
+	return []Conn{conn}
+}
+
+// Connect to the pooled single redis instance, the only one
+func (c *Single) ConnectAll(ctx context.Context) []Conn {
+	var conn Conn
+	conn.Client, conn.Disconnect, _, conn.Err = c.ConnectContext(ctx, nil)
+	return []Conn{conn}
+}
+
+// Returns the address of the single redis instance
+func (c *Single) Addrs(ctx context.Context) ([]string, error) {
+	return []string{c.pool.Addr}, nil
+}
+
+// Connect to the pooled single redis instance, if the address is of it
+func (c *Single) ConnectAddr(ctx context.Context, addr string) Conn {
+	if addr != c.pool.Addr {
+		return Conn{Err: ErrUnknownAddr}
+	}
+	var conn Conn
+	conn.Client, conn.Disconnect, _, conn.Err = c.ConnectContext(ctx, nil)
+	return conn
+}
+
+// Connect to the pooled single redis instance, the only replica
+func (c *Single) ConnectReplicas(ctx context.Context, key []byte) []Conn {
+	return c.ConnectAll(ctx)
+}
+
+// A key has a single replica, the instance
+func (c *Single) Replicas() int {
+	return 1
+}
+
 // Dispose the connector
 func (c *Single) Shutdown() {
 	c.pool.Empty()
@@ -6,6 +6,7 @@
 package zkcluster
 
 import (
+	"context"
 	"encoding/json"
 	"strconv"
 	"strings"
@@ -59,6 +60,8 @@ func NewZKCluster(servers []string, clustername string, timeout time.Duration) (
 		Builder: cluster,
 		Checker: cluster,
 		Failover: cluster.info.Options.FailoverEnabled,
+		Replicas: cluster.info.Options.Replicas,
+		Handoff: cluster.info.Options.HandoffEnabled,
 	}); err != nil {
 		return nil, err
 	} else {
@@ -73,6 +76,41 @@ func (c *ZKCluster) Connect(key []byte) (*redis.Client, func(), int64, error) {
 	return c.connector.Connect(key)
 }
 
+// Locate and connect to an appropriate redis instance with a key within the context.
+func (c *ZKCluster) ConnectContext(ctx context.Context, key []byte) (*redis.Client, func(), int64, error) {
+	return c.connector.ConnectContext(ctx, key)
+}
+
+// Locate and connect to redis instances with multiple keys.
+func (c *ZKCluster) ConnectBatch(ctx context.Context, keys [][]byte) []Conn {
+	return c.connector.ConnectBatch(ctx, keys)
+}
+
+// Connect to every alive redis instance of the cluster.
+func (c *ZKCluster) ConnectAll(ctx context.Context) []Conn {
+	return c.connector.ConnectAll(ctx)
+}
+
+// Returns the addresses of every alive redis instance of the cluster.
+func (c *ZKCluster) Addrs(ctx context.Context) ([]string, error) {
+	return c.connector.Addrs(ctx)
+}
+
+// Connect to the alive redis instance of the address.
+func (c *ZKCluster) ConnectAddr(ctx context.Context, addr string) Conn {
+	return c.connector.ConnectAddr(ctx, addr)
+}
+
+// Connect to the replica redis instances of a key.
+func (c *ZKCluster) ConnectReplicas(ctx context.Context, key []byte) []Conn {
+	return c.connector.ConnectReplicas(ctx, key)
+}
+
+// Returns the number of redis instances which a key is replicated to.
+func (c *ZKCluster) Replicas() int {
+	return c.connector.Replicas()
+}
+
 // Dispose the connector.
 func (c *ZKCluster) Shutdown() {
 	c.Stop()
@@ -14,8 +14,10 @@ import (
 // Cluster options stored on the zookeeper.
 type ZKClusterOptions struct {
 	FailoverEnabled bool
+	HandoffEnabled bool
 	RingType string
 	RingParams string
+	Replicas int
 }
 
 // Cluster information stored on the zookeeper.